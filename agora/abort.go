@@ -0,0 +1,44 @@
+package agora
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+func delete_import_package(agora_url string, api_key string, import_package_id int) error {
+	request_url := join_url(agora_url, "/api/v1/import/")
+	request_url = join_url(request_url, fmt.Sprintf("/%d/", import_package_id)) + "/"
+
+	req, err := http.NewRequest("DELETE", request_url, nil)
+	if err != nil {
+		return err
+	}
+	if api_key != "" {
+		req.Header.Set("Authorization", "X-Agora-Api-Key "+api_key)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not delete the import package. http status = %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// abort_import deletes the import package of a failed upload, so no partial uploads are left on the server
+func abort_import(agora_url string, api_key string, import_package_id int, keep bool) {
+	if keep {
+		logrus.Warningf("the import package %d of the failed upload is kept on the server", import_package_id)
+		return
+	}
+	if err := delete_import_package(agora_url, api_key, import_package_id); err != nil {
+		logrus.Errorf("could not delete the import package %d of the failed upload: %v", import_package_id, err)
+		return
+	}
+	logrus.Warningf("the import package %d of the failed upload was deleted", import_package_id)
+}
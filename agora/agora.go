@@ -5,13 +5,24 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// PARALLEL_UPLOADS is the number of files which are uploaded concurrently. The connection pool of the shared
+// transport is sized accordingly when an upload starts.
+var PARALLEL_UPLOADS = 3
+
+// all requests share one transport, so connections are reused and the timeouts apply everywhere
+var httpTransport = newTransport()
+var httpClient = &http.Client{Transport: httpTransport}
+
 type ApiKeyResponse struct {
 	ApiKey string `json:"key"`
 }
@@ -28,14 +39,45 @@ func basicAuth(username, password string) string {
 	return base64.StdEncoding.EncodeToString([]byte(auth))
 }
 
+func newTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   15 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Minute,
+		ExpectContinueTimeout: 1 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+	}
+}
+
+var poolMutex sync.Mutex
+
+// size_connection_pool makes sure the shared transport keeps enough idle connections for the given number of
+// concurrent uploads: one per upload worker plus two for polling the import progress and the flow file states. The
+// pool is only grown, so an upload which runs alongside others (e.g. in a batch) never changes it while they send
+// requests, as long as the pool was sized for all of them before they started.
+func size_connection_pool(uploads int) {
+	poolMutex.Lock()
+	defer poolMutex.Unlock()
+	size := uploads * (PARALLEL_UPLOADS + 2)
+	if httpTransport.MaxIdleConnsPerHost < size {
+		httpTransport.MaxIdleConns = size
+		httpTransport.MaxIdleConnsPerHost = size
+	}
+}
+
 func HandleNoCertificateCheck(no_certificate_check bool) {
 	if no_certificate_check {
-		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		httpTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
 }
 
 func GetRequest(request_url string, api_key string, user string, password string) (*http.Response, error) {
-	client := &http.Client{}
 	req, err := http.NewRequest("GET", request_url, nil)
 	if err != nil {
 		return nil, err
@@ -46,7 +88,7 @@ func GetRequest(request_url string, api_key string, user string, password string
 	} else if user != "" && password != "" {
 		req.Header.Add("Authorization", "Basic "+basicAuth(user, password))
 	}
-	resp, err := client.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -54,7 +96,6 @@ func GetRequest(request_url string, api_key string, user string, password string
 }
 
 func PostRequest(request_url string, body []byte, api_key string, user string, password string, content_type string) (*http.Response, error) {
-	client := &http.Client{}
 	req, err := http.NewRequest("POST", request_url, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, err
@@ -68,7 +109,7 @@ func PostRequest(request_url string, body []byte, api_key string, user string, p
 	if content_type != "" {
 		req.Header.Set("Content-Type", content_type)
 	}
-	resp, err := client.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -78,13 +119,21 @@ func PostRequest(request_url string, body []byte, api_key string, user string, p
 func Ping(agora_url string) (bool, error) {
 	request_url := join_url(agora_url, "/api/v1/version/")
 	resp, err := GetRequest(request_url, "", "", "")
-	return err == nil && resp.StatusCode == 200, err
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == 200, nil
 }
 
 func CheckConnection(agora_url string, apikey string) (bool, error) {
 	request_url := join_url(agora_url, "/api/v1/user/current/")
 	resp, err := GetRequest(request_url, apikey, "", "")
-	return err == nil && resp.StatusCode == 200, err
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == 200, nil
 }
 
 func GetApiKey(agora_url string, user string, password string) string {
@@ -98,6 +147,7 @@ func GetApiKey(agora_url string, user string, password string) string {
 	if err != nil {
 		logrus.Fatal(err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode == 404 {
 		logrus.Fatal("No api-key found. Please create an api-key in your Agora user profile")
 	} else if resp.StatusCode > 299 {
@@ -0,0 +1,238 @@
+package agora
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// BatchJob is one row of a batch file: a file or folder and the target it is uploaded to
+type BatchJob struct {
+	Path           string `yaml:"path" json:"path"`
+	TargetFolderId int    `yaml:"target_folder" json:"target_folder_id,omitempty"`
+	ExamId         int    `yaml:"exam" json:"exam_id,omitempty"`
+	SeriesId       int    `yaml:"series" json:"series_id,omitempty"`
+	JsonImportFile string `yaml:"import_json" json:"import_json,omitempty"`
+	ExtractZip     bool   `yaml:"extract_zip" json:"extract_zip,omitempty"`
+}
+
+type BatchOptions struct {
+	// the options which are common to all jobs. The target, import-json and extract-zip are taken from the jobs.
+	Upload UploadOptions
+	// the number of jobs which are uploaded at the same time
+	Jobs int
+}
+
+type BatchJobReport struct {
+	Job     BatchJob `json:"job"`
+	Success bool     `json:"success"`
+	Error   string   `json:"error,omitempty"`
+	Report  *Report  `json:"report,omitempty"`
+}
+
+// BatchReport summarizes all jobs of a batch. The jobs are in the order of the batch file.
+type BatchReport struct {
+	Url       string           `json:"url"`
+	DryRun    bool             `json:"dry_run"`
+	StartTime time.Time        `json:"start_time"`
+	Duration  float64          `json:"duration"`
+	Success   bool             `json:"success"`
+	Failed    int              `json:"failed"`
+	Jobs      []BatchJobReport `json:"jobs"`
+}
+
+func (r *BatchReport) Json() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+func (r *BatchReport) Save(path string) error {
+	data, err := r.Json()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func parse_batch_int(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// parse_batch_csv parses a csv file with a header. The columns are named like the yaml keys of BatchJob.
+func parse_batch_csv(r io.Reader) ([]BatchJob, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the header: %w", err)
+	}
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		switch column {
+		case "path", "target_folder", "exam", "series", "import_json", "extract_zip":
+		default:
+			return nil, fmt.Errorf("unknown column %q, expected: path, target_folder, exam, series, import_json, extract_zip", column)
+		}
+		header[i] = column
+	}
+
+	jobs := []BatchJob{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		job := BatchJob{}
+		for i, value := range record {
+			value = strings.TrimSpace(value)
+			switch header[i] {
+			case "path":
+				job.Path = value
+			case "target_folder":
+				job.TargetFolderId, err = parse_batch_int(value)
+			case "exam":
+				job.ExamId, err = parse_batch_int(value)
+			case "series":
+				job.SeriesId, err = parse_batch_int(value)
+			case "import_json":
+				job.JsonImportFile = value
+			case "extract_zip":
+				if value != "" {
+					job.ExtractZip, err = strconv.ParseBool(value)
+				}
+			}
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid %s %q", line, header[i], value)
+			}
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// LoadBatchFile reads the jobs of a batch from a csv or yaml file. Relative paths in the file are relative to the
+// folder of the batch file.
+func LoadBatchFile(path string) ([]BatchJob, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var jobs []BatchJob
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		jobs, err = parse_batch_csv(file)
+	case ".yaml", ".yml":
+		err = yaml.NewDecoder(file).Decode(&jobs)
+	default:
+		return nil, fmt.Errorf("unknown batch file format %q, expected a .csv, .yaml or .yml file", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read the batch file %s: %w", path, err)
+	}
+
+	base_dir := filepath.Dir(path)
+	for i := range jobs {
+		job := &jobs[i]
+		if job.Path == "" {
+			return nil, fmt.Errorf("job %d in %s has no path", i+1, path)
+		}
+		if job.TargetFolderId <= 0 && job.ExamId <= 0 && job.SeriesId <= 0 {
+			return nil, fmt.Errorf("job %d in %s (%s) has no target folder, exam or series", i+1, path, job.Path)
+		}
+		if !filepath.IsAbs(job.Path) {
+			job.Path = filepath.Join(base_dir, job.Path)
+		}
+	}
+	return jobs, nil
+}
+
+// RunBatch uploads all jobs of a batch, at most options.Jobs at the same time. A failed job does not stop the
+// others. An error is returned if any of the jobs failed. If the context is cancelled, the running jobs are aborted and
+// no more jobs are started.
+func RunBatch(ctx context.Context, agora_url string, api_key string, jobs []BatchJob, options BatchOptions) (*BatchReport, error) {
+	report := &BatchReport{Url: agora_url, DryRun: options.Upload.DryRun, StartTime: time.Now(), Jobs: make([]BatchJobReport, len(jobs))}
+	concurrency := options.Jobs
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > 1 {
+		// the progress bars of concurrent uploads would overwrite each other
+		options.Upload.ShowProgress = false
+	}
+	// the pool is sized for all concurrent jobs before any of them starts
+	size_connection_pool(concurrency)
+
+	slots := make(chan bool, concurrency)
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		select {
+		case slots <- true:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			report.Jobs[i] = BatchJobReport{Job: job, Error: "the batch was interrupted before the job was started"}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, job BatchJob) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			logrus.Infof("Starting job %d of %d: %s", i+1, len(jobs), job.Path)
+			upload_options := options.Upload
+			upload_options.TargetFolderId = job.TargetFolderId
+			upload_options.ExamId = job.ExamId
+			upload_options.SeriesId = job.SeriesId
+			upload_options.JsonImportFile = job.JsonImportFile
+			upload_options.ExtractZip = job.ExtractZip
+			job_report, err := UploadContext(ctx, agora_url, api_key, job.Path, upload_options)
+
+			result := BatchJobReport{Job: job, Success: err == nil && job_report != nil && job_report.Success, Report: job_report}
+			if err == nil && !result.Success {
+				err = errors.New("not all files were uploaded")
+			}
+			if err != nil {
+				result.Error = err.Error()
+				logrus.Errorf("Job %d of %d (%s) failed: %v", i+1, len(jobs), job.Path, err)
+			} else {
+				logrus.Infof("Job %d of %d (%s) finished", i+1, len(jobs), job.Path)
+			}
+			report.Jobs[i] = result
+		}(i, job)
+	}
+	wg.Wait()
+
+	report.Duration = time.Since(report.StartTime).Seconds()
+	for _, job := range report.Jobs {
+		if !job.Success {
+			report.Failed++
+		}
+	}
+	report.Success = report.Failed == 0
+	logrus.Infof("Batch finished: %d of %d jobs succeeded", len(jobs)-report.Failed, len(jobs))
+	if report.Failed > 0 {
+		return report, fmt.Errorf("%d of %d jobs failed", report.Failed, len(jobs))
+	}
+	return report, nil
+}
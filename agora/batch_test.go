@@ -0,0 +1,84 @@
+package agora
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseBatchCsv(t *testing.T) {
+	tests := []struct {
+		name    string
+		csv     string
+		want    []BatchJob
+		wantErr string
+	}{
+		{
+			name: "all columns",
+			csv: "path,target_folder,exam,series,import_json,extract_zip\n" +
+				"/data/exam_1,13,,,,\n" +
+				"/data/exam_2.zip,,42,7,import.json,true\n",
+			want: []BatchJob{
+				{Path: "/data/exam_1", TargetFolderId: 13},
+				{Path: "/data/exam_2.zip", ExamId: 42, SeriesId: 7, JsonImportFile: "import.json", ExtractZip: true},
+			},
+		},
+		{
+			name: "columns in any order and case",
+			csv:  "Target_Folder, PATH\n13, /data/exam_1\n",
+			want: []BatchJob{{Path: "/data/exam_1", TargetFolderId: 13}},
+		},
+		{
+			name: "comments and spaces",
+			csv:  "path,target_folder\n# the first exam\n  /data/exam_1 ,  13\n",
+			want: []BatchJob{{Path: "/data/exam_1", TargetFolderId: 13}},
+		},
+		{
+			name: "only a header",
+			csv:  "path,target_folder\n",
+			want: []BatchJob{},
+		},
+		{
+			name:    "empty file",
+			csv:     "",
+			wantErr: "could not read the header",
+		},
+		{
+			name:    "unknown column",
+			csv:     "path,folder\n/data,13\n",
+			wantErr: `unknown column "folder"`,
+		},
+		{
+			name:    "invalid id",
+			csv:     "path,target_folder\n/data/exam_1,13\n/data/exam_2,abc\n",
+			wantErr: `line 3: invalid target_folder "abc"`,
+		},
+		{
+			name:    "invalid bool",
+			csv:     "path,extract_zip\n/data/exam_1.zip,maybe\n",
+			wantErr: `line 2: invalid extract_zip "maybe"`,
+		},
+		{
+			name:    "wrong number of fields",
+			csv:     "path,target_folder\n/data/exam_1,13,14\n",
+			wantErr: "wrong number of fields",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobs, err := parse_batch_csv(strings.NewReader(tt.csv))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parse_batch_csv() error = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse_batch_csv() error = %v", err)
+			}
+			if !reflect.DeepEqual(jobs, tt.want) {
+				t.Errorf("parse_batch_csv() = %+v, want %+v", jobs, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,402 @@
+package agora
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	BUNDLE_FORMAT_ZIP = "zip"
+	BUNDLE_FORMAT_TAR = "tar"
+	BUNDLE_FORMAT_TGZ = "tgz"
+)
+
+const (
+	// the files of a directory (e.g. a DICOM series) are kept together in one bundle, if they fit into one
+	BUNDLE_STRATEGY_DIRECTORY = "directory"
+	// the files are packed in the order in which they are found
+	BUNDLE_STRATEGY_SEQUENTIAL = "sequential"
+)
+
+// the size of the zip headers of an entry without the name: local file header (30), data descriptor (24),
+// central directory header (46), the zip64 extra fields (2 * 28) and the extended timestamps (2 * 9)
+const zipEntryOverhead = 30 + 24 + 46 + 2*28 + 2*9
+
+const tarBlockSize = 512
+
+// bundler creates the bundles of the small files in one of the BUNDLE_FORMATs. The compression is only used for
+// zip bundles, tgz bundles are always compressed with gzip (with the level of the compression).
+type bundler struct {
+	format      string
+	strategy    string
+	compression compression
+	// the bundles of every upload get unique names, so they don't collide with the bundles of earlier uploads into
+	// the same import package
+	run_id string
+}
+
+func new_bundler(format string, strategy string, compression compression) (bundler, error) {
+	switch strategy {
+	case "":
+		strategy = BUNDLE_STRATEGY_DIRECTORY
+	case BUNDLE_STRATEGY_DIRECTORY, BUNDLE_STRATEGY_SEQUENTIAL:
+	default:
+		return bundler{}, fmt.Errorf("unknown bundle strategy %q, expected one of: %s, %s", strategy, BUNDLE_STRATEGY_DIRECTORY, BUNDLE_STRATEGY_SEQUENTIAL)
+	}
+	switch format {
+	case "":
+		format = BUNDLE_FORMAT_ZIP
+	case BUNDLE_FORMAT_ZIP, BUNDLE_FORMAT_TAR, BUNDLE_FORMAT_TGZ:
+	default:
+		return bundler{}, fmt.Errorf("unknown bundle format %q, expected one of: %s, %s, %s", format, BUNDLE_FORMAT_ZIP, BUNDLE_FORMAT_TAR, BUNDLE_FORMAT_TGZ)
+	}
+	run_id := strings.ReplaceAll(uuid.New().String(), "-", "")[:8]
+	return bundler{format: format, strategy: strategy, compression: compression, run_id: run_id}, nil
+}
+
+func (b bundler) String() string {
+	switch b.format {
+	case BUNDLE_FORMAT_TAR:
+		return "tar"
+	case BUNDLE_FORMAT_TGZ:
+		return "tar.gz"
+	}
+	return fmt.Sprintf("zip, %s compression", b.compression)
+}
+
+func (b bundler) name(index int) string {
+	switch b.format {
+	case BUNDLE_FORMAT_TAR:
+		return fmt.Sprintf("upload_%s_%d.agora_upload.tar", b.run_id, index)
+	case BUNDLE_FORMAT_TGZ:
+		return fmt.Sprintf("upload_%s_%d.agora_upload.tar.gz", b.run_id, index)
+	}
+	return fmt.Sprintf("upload_%s_%d.agora_upload", b.run_id, index)
+}
+
+// ARCHIVE_EXTENSIONS are the archives which can be extracted on the server
+var ARCHIVE_EXTENSIONS = []string{".zip", ".tar", ".tar.gz", ".tgz"}
+
+func is_archive(path string) bool {
+	lower := strings.ToLower(path)
+	for _, ext := range ARCHIVE_EXTENSIONS {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func round_to_block(size int64) int64 {
+	return (size + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+}
+
+// entry_size returns an upper bound of the bytes a file takes up in a bundle. Deflate adds at most 5 bytes per
+// 16 KB block to data which can't be compressed.
+func (b bundler) entry_size(file UploadFile) int64 {
+	xattrs_size := int64(len(encode_xattrs(file.Xattrs)))
+	switch b.format {
+	case BUNDLE_FORMAT_TAR, BUNDLE_FORMAT_TGZ:
+		// the header, a pax header for long names and the extended attributes (with their records) and the data
+		size := 2*tarBlockSize + round_to_block(2*int64(len(file.TargetPath))+2*xattrs_size+tarBlockSize) + round_to_block(file.Size)
+		if b.format == BUNDLE_FORMAT_TGZ {
+			size += (size/16384 + 1) * 5
+		}
+		return size
+	}
+	return file.Size + (file.Size/16384+1)*5 + zipEntryOverhead + 2*(int64(len(file.TargetPath))+xattrs_size)
+}
+
+// overhead returns the size of a bundle without any files
+func (b bundler) overhead() int64 {
+	switch b.format {
+	case BUNDLE_FORMAT_TAR:
+		// two empty blocks mark the end
+		return 2 * tarBlockSize
+	case BUNDLE_FORMAT_TGZ:
+		// the gzip header and footer
+		return 2*tarBlockSize + 64
+	}
+	// the end of central directory records
+	return 22 + 56 + 20
+}
+
+type bundlePlan struct {
+	bundler bundler
+	bundles [][]UploadFile
+	bundle  []UploadFile
+	size    int64
+}
+
+func (p *bundlePlan) fits(size int64, count int) bool {
+	return p.size+size <= MAX_ZIP_SIZE && len(p.bundle)+count <= MAX_ZIP_FILES
+}
+
+func (p *bundlePlan) close() {
+	if len(p.bundle) > 0 {
+		p.bundles = append(p.bundles, p.bundle)
+	}
+	p.bundle = nil
+	p.size = p.bundler.overhead()
+}
+
+func (p *bundlePlan) add(file UploadFile, entry_size int64) {
+	if len(p.bundle) > 0 && !p.fits(entry_size, 1) {
+		p.close()
+	}
+	file.Bundle = p.bundler.name(len(p.bundles))
+	p.bundle = append(p.bundle, file)
+	p.size += entry_size
+}
+
+// plan_bundles splits the files which are zipped into bundles. A bundle is closed as soon as it would contain more
+// than MAX_ZIP_FILES files or the size of its entries (including the headers) would exceed MAX_ZIP_SIZE, so the
+// bundles never get larger than that, unless a single file is already larger. With BUNDLE_STRATEGY_DIRECTORY a
+// directory which doesn't fit into the current bundle starts a new one, so it is only split if it is too large
+// for a single bundle.
+func plan_bundles(files_to_zip []UploadFile, b bundler) [][]UploadFile {
+	plan := &bundlePlan{bundler: b, size: b.overhead()}
+	if b.strategy == BUNDLE_STRATEGY_SEQUENTIAL {
+		for _, file := range files_to_zip {
+			plan.add(file, b.entry_size(file))
+		}
+		plan.close()
+		return plan.bundles
+	}
+
+	// the directories are kept in the order in which they are found
+	dirs := []string{}
+	groups := make(map[string][]UploadFile)
+	for _, file := range files_to_zip {
+		dir := path.Dir(file.TargetPath)
+		if _, ok := groups[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		groups[dir] = append(groups[dir], file)
+	}
+	for _, dir := range dirs {
+		group := groups[dir]
+		var group_size int64
+		for _, file := range group {
+			group_size += b.entry_size(file)
+		}
+		if !plan.fits(group_size, len(group)) {
+			plan.close()
+		}
+		for _, file := range group {
+			plan.add(file, b.entry_size(file))
+		}
+	}
+	plan.close()
+	return plan.bundles
+}
+
+// bundleContents are the files of a bundle, which is created while it is uploaded. The files which have to be left
+// out of the bundle are recorded in the report.
+type bundleContents struct {
+	bundler bundler
+	files   []UploadFile
+	report  *Report
+}
+
+// size_bound returns an upper bound of the size of a bundle
+func (b bundler) size_bound(bundle []UploadFile) int64 {
+	size := b.overhead()
+	for _, file := range bundle {
+		size += b.entry_size(file)
+	}
+	return size
+}
+
+// bundleWriter adds files to a bundle
+type bundleWriter interface {
+	create(file UploadFile, info os.FileInfo) (io.Writer, error)
+	Close() error
+}
+
+type zipBundleWriter struct {
+	w           *zip.Writer
+	compression compression
+}
+
+func (z *zipBundleWriter) create(file UploadFile, info os.FileInfo) (io.Writer, error) {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return nil, err
+	}
+	header.Name = file.TargetPath
+	header.Method = z.compression.method_for(file)
+	header.Extra = encode_xattrs(file.Xattrs)
+	return z.w.CreateHeader(header)
+}
+
+func (z *zipBundleWriter) Close() error {
+	return z.w.Close()
+}
+
+type tarBundleWriter struct {
+	w  *tar.Writer
+	gz *gzip.Writer
+}
+
+func (t *tarBundleWriter) create(file UploadFile, info os.FileInfo) (io.Writer, error) {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return nil, err
+	}
+	header.Name = file.TargetPath
+	if len(file.Xattrs) > 0 {
+		header.PAXRecords = make(map[string]string)
+		for name, value := range file.Xattrs {
+			header.PAXRecords["SCHILY.xattr."+name] = string(value)
+		}
+	}
+	if err := t.w.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	return t.w, nil
+}
+
+func (t *tarBundleWriter) Close() error {
+	err := t.w.Close()
+	if t.gz != nil {
+		if gz_err := t.gz.Close(); err == nil {
+			err = gz_err
+		}
+	}
+	return err
+}
+
+func (b bundler) new_writer(w io.Writer) (bundleWriter, error) {
+	switch b.format {
+	case BUNDLE_FORMAT_TAR:
+		return &tarBundleWriter{w: tar.NewWriter(w)}, nil
+	case BUNDLE_FORMAT_TGZ:
+		level := gzip.DefaultCompression
+		if b.compression.method == zip.Deflate && b.compression.level != 0 {
+			level = b.compression.level
+		}
+		gz, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		return &tarBundleWriter{w: tar.NewWriter(gz), gz: gz}, nil
+	}
+	return &zipBundleWriter{w: b.compression.new_zip_writer(w), compression: b.compression}, nil
+}
+
+// skippedFileError is returned for a file which can't be added to a bundle as it was planned, e.g. because it was
+// deleted or its size has changed since the scan. Only the file is left out, the bundle is still created.
+type skippedFileError struct {
+	err error
+}
+
+func (e *skippedFileError) Error() string {
+	return e.err.Error()
+}
+
+func (e *skippedFileError) Unwrap() error {
+	return e.err
+}
+
+func add_to_bundle(w bundleWriter, file UploadFile) error {
+	logrus.Debugf("adding file to bundle: %s (path in bundle: %s)", file.SourcePath, file.TargetPath)
+	r, err := os.Open(file.SourcePath)
+	if err != nil {
+		return &skippedFileError{fmt.Errorf("could not open the file %s: %w", file.SourcePath, err)}
+	}
+	defer r.Close()
+
+	// the modification time and the mode are taken from the file when it is added
+	info, err := r.Stat()
+	if err != nil {
+		return &skippedFileError{fmt.Errorf("could not get the file info of %s: %w", file.SourcePath, err)}
+	}
+	// the size of the bundle was planned with the size of the scan
+	if info.Size() != file.Size {
+		return &skippedFileError{fmt.Errorf("the size of %s has changed from %d to %d bytes since it was scanned", file.SourcePath, file.Size, info.Size())}
+	}
+	f, err := w.create(file, info)
+	if err != nil {
+		return fmt.Errorf("could not create the path %s in the bundle: %w", file.TargetPath, err)
+	}
+	// once the entry is created the file can't be left out anymore. Only the planned size is added, a file which
+	// grows in the meantime must not exceed the size of the bundle.
+	hashing := new_hashing_reader(r)
+	n, err := io.CopyN(f, hashing, file.Size)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("could not add %s to the bundle: %w", file.SourcePath, err)
+	}
+	if n != file.Size {
+		return fmt.Errorf("the size of %s has changed from %d to %d bytes while it was bundled", file.SourcePath, file.Size, n)
+	}
+	if extra, _ := r.Read(make([]byte, 1)); extra > 0 {
+		return fmt.Errorf("the file %s has grown while it was bundled", file.SourcePath)
+	}
+	hashing.store(file)
+	return nil
+}
+
+// countingWriter counts the bytes which are written
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (b bundler) write(w io.Writer, contents *bundleContents, events *notifier) error {
+	bw, err := b.new_writer(w)
+	if err != nil {
+		return err
+	}
+	for _, file := range contents.files {
+		err := add_to_bundle(bw, file)
+		var skipped *skippedFileError
+		if errors.As(err, &skipped) {
+			logrus.Warningf("%v. the file is left out of the bundle %s", err, file.Bundle)
+			contents.report.skip_file(file.TargetPath, err)
+			events.error(file.SourcePath, err)
+			continue
+		}
+		if err != nil {
+			bw.Close()
+			return err
+		}
+		events.file_zipped(file)
+	}
+	return bw.Close()
+}
+
+// stream creates a bundle while it is read, so a bundle is never kept in memory or on disk as a whole. Every file is
+// closed as soon as it is added, so only one file is open at a time, independent of the number of files in the
+// bundle. An error while creating the bundle is returned by the reader.
+func (b bundler) stream(name string, contents *bundleContents, events *notifier) io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		counter := &countingWriter{w: w}
+		err := b.write(counter, contents, events)
+		if err != nil {
+			err = fmt.Errorf("could not create the bundle %s: %w", name, err)
+		} else {
+			logrus.Debugf("created bundle %s: %d files, %s", name, len(contents.files), format_size(counter.n))
+			events.bundle_created(name, len(contents.files), counter.n)
+		}
+		w.CloseWithError(err)
+	}()
+	return r
+}
@@ -0,0 +1,249 @@
+package agora
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// create_test_file writes a file below dir and returns it as it is scanned for an upload
+func create_test_file(t *testing.T, dir string, target_path string, data []byte) UploadFile {
+	t.Helper()
+	source_path := filepath.Join(dir, filepath.FromSlash(target_path))
+	if err := os.MkdirAll(filepath.Dir(source_path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(source_path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(source_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return UploadFile{SourcePath: source_path, TargetPath: target_path, Size: info.Size(), ModTime: info.ModTime(), Mode: info.Mode()}
+}
+
+func random_data(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func test_bundler(t *testing.T, format string, strategy string, compression_name string) bundler {
+	t.Helper()
+	c, err := parse_compression(compression_name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := new_bundler(format, strategy, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// set_bundle_limits changes the limits of the bundles for a test
+func set_bundle_limits(t *testing.T, max_size int64, max_files int) {
+	old_size, old_files := MAX_ZIP_SIZE, MAX_ZIP_FILES
+	MAX_ZIP_SIZE, MAX_ZIP_FILES = max_size, max_files
+	t.Cleanup(func() {
+		MAX_ZIP_SIZE, MAX_ZIP_FILES = old_size, old_files
+	})
+}
+
+func bundle_paths(bundles [][]UploadFile) [][]string {
+	paths := [][]string{}
+	for _, bundle := range bundles {
+		names := []string{}
+		for _, file := range bundle {
+			names = append(names, file.TargetPath)
+		}
+		paths = append(paths, names)
+	}
+	return paths
+}
+
+func TestPlanBundles(t *testing.T) {
+	// files of 1000 bytes, so the size of the bundles only depends on the number of files
+	files := func(paths ...string) []UploadFile {
+		result := []UploadFile{}
+		for _, path := range paths {
+			result = append(result, UploadFile{TargetPath: path, Size: 1000})
+		}
+		return result
+	}
+	b := test_bundler(t, BUNDLE_FORMAT_ZIP, BUNDLE_STRATEGY_DIRECTORY, COMPRESSION_DEFLATE)
+	entry := b.entry_size(UploadFile{TargetPath: "a/1", Size: 1000})
+
+	tests := []struct {
+		name      string
+		strategy  string
+		max_files int
+		// the maximum size of a bundle in entries
+		max_entries int64
+		files       []UploadFile
+		want        [][]string
+	}{
+		{
+			name:     "no files",
+			strategy: BUNDLE_STRATEGY_DIRECTORY, max_files: 10, max_entries: 10,
+			files: files(),
+			want:  [][]string{},
+		},
+		{
+			name:     "everything fits into one bundle",
+			strategy: BUNDLE_STRATEGY_DIRECTORY, max_files: 10, max_entries: 10,
+			files: files("a/1", "a/2", "b/1"),
+			want:  [][]string{{"a/1", "a/2", "b/1"}},
+		},
+		{
+			name:     "sequential splits at the file limit",
+			strategy: BUNDLE_STRATEGY_SEQUENTIAL, max_files: 2, max_entries: 10,
+			files: files("a/1", "a/2", "a/3", "b/1", "b/2"),
+			want:  [][]string{{"a/1", "a/2"}, {"a/3", "b/1"}, {"b/2"}},
+		},
+		{
+			name:     "sequential splits at the size limit",
+			strategy: BUNDLE_STRATEGY_SEQUENTIAL, max_files: 10, max_entries: 2,
+			files: files("a/1", "a/2", "a/3"),
+			want:  [][]string{{"a/1", "a/2"}, {"a/3"}},
+		},
+		{
+			name:     "directory keeps a folder together",
+			strategy: BUNDLE_STRATEGY_DIRECTORY, max_files: 3, max_entries: 10,
+			files: files("a/1", "a/2", "b/1", "b/2"),
+			want:  [][]string{{"a/1", "a/2"}, {"b/1", "b/2"}},
+		},
+		{
+			name:     "directory groups the files of a folder which are found apart",
+			strategy: BUNDLE_STRATEGY_DIRECTORY, max_files: 10, max_entries: 10,
+			files: files("a/1", "b/1", "a/2"),
+			want:  [][]string{{"a/1", "a/2", "b/1"}},
+		},
+		{
+			name:     "directory splits a folder which is too large for one bundle",
+			strategy: BUNDLE_STRATEGY_DIRECTORY, max_files: 2, max_entries: 10,
+			files: files("a/1", "b/1", "b/2", "b/3"),
+			want:  [][]string{{"a/1"}, {"b/1", "b/2"}, {"b/3"}},
+		},
+		{
+			name:     "directory splits at the size limit",
+			strategy: BUNDLE_STRATEGY_DIRECTORY, max_files: 10, max_entries: 2,
+			files: files("a/1", "a/2", "a/3"),
+			want:  [][]string{{"a/1", "a/2"}, {"a/3"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := test_bundler(t, BUNDLE_FORMAT_ZIP, tt.strategy, COMPRESSION_DEFLATE)
+			set_bundle_limits(t, b.overhead()+tt.max_entries*entry, tt.max_files)
+
+			bundles := plan_bundles(tt.files, b)
+			if got := bundle_paths(bundles); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("plan_bundles() = %v, want %v", got, tt.want)
+			}
+			for i, bundle := range bundles {
+				if size := b.size_bound(bundle); size > MAX_ZIP_SIZE {
+					t.Errorf("bundle %d has a size bound of %d bytes, more than %d", i, size, MAX_ZIP_SIZE)
+				}
+				for _, file := range bundle {
+					if file.Bundle != b.name(i) {
+						t.Errorf("%s is in the bundle %q, want %q", file.TargetPath, file.Bundle, b.name(i))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPlanBundlesLargeFile(t *testing.T) {
+	b := test_bundler(t, BUNDLE_FORMAT_ZIP, BUNDLE_STRATEGY_SEQUENTIAL, COMPRESSION_DEFLATE)
+	set_bundle_limits(t, 10000, 10)
+
+	files := []UploadFile{{TargetPath: "small", Size: 100}, {TargetPath: "large", Size: 20000}, {TargetPath: "small2", Size: 100}}
+	got := bundle_paths(plan_bundles(files, b))
+	want := [][]string{{"small"}, {"large"}, {"small2"}}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("plan_bundles() = %v, want %v", got, want)
+	}
+}
+
+// The bundles are streamed in chunks with the size which was planned, so a bundle must never be larger than its
+// size bound, whatever the format, the compression and the content of the files.
+func TestBundleSizeBound(t *testing.T) {
+	dir := t.TempDir()
+	long_name := strings.Repeat("long_folder_name/", 20) + "file.dcm"
+	files := []UploadFile{
+		create_test_file(t, dir, "empty", []byte{}),
+		create_test_file(t, dir, "series_1/random.dcm", random_data(1, 100000)),
+		create_test_file(t, dir, "series_1/zeros.dcm", make([]byte, 100000)),
+		create_test_file(t, dir, "series_2/small.dcm", []byte("x")),
+		create_test_file(t, dir, "series_2/block.dcm", random_data(2, 512)),
+		create_test_file(t, dir, "series_2/compressed.gz", random_data(3, 20000)),
+		create_test_file(t, dir, "series_2/deflate_blocks.dcm", random_data(4, 5*16384+1)),
+		create_test_file(t, dir, long_name, random_data(5, 1000)),
+	}
+	with_xattrs := create_test_file(t, dir, "series_3/xattrs.dcm", random_data(6, 3000))
+	with_xattrs.Xattrs = map[string][]byte{"user.comment": []byte("patient 1"), "user." + strings.Repeat("x", 200): random_data(7, 300)}
+	files = append(files, with_xattrs)
+
+	tests := []struct {
+		format      string
+		compression string
+	}{
+		{BUNDLE_FORMAT_ZIP, COMPRESSION_STORE},
+		{BUNDLE_FORMAT_ZIP, COMPRESSION_DEFLATE},
+		{BUNDLE_FORMAT_TAR, COMPRESSION_DEFLATE},
+		{BUNDLE_FORMAT_TGZ, COMPRESSION_DEFLATE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format+"_"+tt.compression, func(t *testing.T) {
+			b := test_bundler(t, tt.format, BUNDLE_STRATEGY_SEQUENTIAL, tt.compression)
+			for _, bundle := range [][]UploadFile{files[:0], files[:1], files[1:2], files} {
+				contents := &bundleContents{bundler: b, files: bundle, report: new_report("", UploadOptions{})}
+				var buffer bytes.Buffer
+				if err := b.write(&buffer, contents, nil); err != nil {
+					t.Fatal(err)
+				}
+				if size, bound := int64(buffer.Len()), b.size_bound(bundle); size > bound {
+					t.Errorf("a bundle of %d files has %d bytes, more than its size bound of %d bytes", len(bundle), size, bound)
+				}
+			}
+		})
+	}
+}
+
+func TestBundleSkipsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := []UploadFile{
+		create_test_file(t, dir, "a/1", []byte("first")),
+		create_test_file(t, dir, "a/2", []byte("second")),
+		create_test_file(t, dir, "a/3", []byte("third")),
+	}
+	if err := os.Remove(files[1].SourcePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(files[2].SourcePath, []byte("third, but longer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := test_bundler(t, BUNDLE_FORMAT_ZIP, BUNDLE_STRATEGY_SEQUENTIAL, COMPRESSION_DEFLATE)
+	report := new_report("", UploadOptions{})
+	var buffer bytes.Buffer
+	if err := b.write(&buffer, &bundleContents{bundler: b, files: files, report: report}, nil); err != nil {
+		t.Fatalf("write() error = %v, want only the changed files to be left out", err)
+	}
+	for _, path := range []string{"a/2", "a/3"} {
+		if _, ok := report.skipped_files[path]; !ok {
+			t.Errorf("%s was not left out of the bundle", path)
+		}
+	}
+	if _, ok := report.skipped_files["a/1"]; ok {
+		t.Errorf("a/1 was left out of the bundle")
+	}
+}
@@ -0,0 +1,97 @@
+package agora
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	COMPRESSION_STORE   = "store"
+	COMPRESSION_DEFLATE = "deflate"
+	// COMPRESSION_ZSTD selects zstd if the server supports zip bundles with zstd. No server announces this yet, so it
+	// currently always falls back to deflate.
+	COMPRESSION_ZSTD = "zstd-if-supported"
+)
+
+// STORED_EXTENSIONS are the extensions of files which are already compressed. They are always stored in the zip
+// bundles without compression, since compressing them again only costs CPU time.
+var STORED_EXTENSIONS = []string{
+	".gz", ".tgz", ".bz2", ".xz", ".zst", ".zip", ".7z", ".rar",
+	".jpg", ".jpeg", ".jp2", ".j2k", ".png", ".gif", ".webp",
+	".mp4", ".mov", ".avi", ".mkv", ".mp3",
+}
+
+type compression struct {
+	method uint16
+	level  int
+}
+
+// parse_compression checks the compression and its level. A level of 0 selects the default level.
+func parse_compression(name string, level int) (compression, error) {
+	switch name {
+	case "", COMPRESSION_DEFLATE:
+		if level != 0 && (level < flate.BestSpeed || level > flate.BestCompression) {
+			return compression{}, fmt.Errorf("invalid deflate compression level %d, expected 1-9", level)
+		}
+		return compression{method: zip.Deflate, level: level}, nil
+	case COMPRESSION_STORE:
+		return compression{method: zip.Store}, nil
+	case COMPRESSION_ZSTD:
+		if level < 0 || level > 22 {
+			return compression{}, fmt.Errorf("invalid zstd compression level %d, expected 1-22", level)
+		}
+		// the level of zstd has a different range, the closest deflate level is used
+		if level > flate.BestCompression {
+			level = flate.BestCompression
+		}
+		logrus.Infof("The server does not support zstd compressed bundles, using %s instead", compression{method: zip.Deflate, level: level})
+		return compression{method: zip.Deflate, level: level}, nil
+	}
+	return compression{}, fmt.Errorf("unknown compression %q, expected one of: %s, %s, %s", name, COMPRESSION_STORE, COMPRESSION_DEFLATE, COMPRESSION_ZSTD)
+}
+
+func (c compression) String() string {
+	if c.method == zip.Store {
+		return COMPRESSION_STORE
+	}
+	if c.level == 0 {
+		return COMPRESSION_DEFLATE
+	}
+	return fmt.Sprintf("%s (level %d)", COMPRESSION_DEFLATE, c.level)
+}
+
+func is_compressed(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, stored := range STORED_EXTENSIONS {
+		if ext == stored {
+			return true
+		}
+	}
+	return false
+}
+
+// method returns the zip method of a file
+func (c compression) method_for(file UploadFile) uint16 {
+	if is_compressed(file.TargetPath) {
+		return zip.Store
+	}
+	return c.method
+}
+
+// new_zip_writer creates a zip writer with the compressors for the compression level
+func (c compression) new_zip_writer(w io.Writer) *zip.Writer {
+	zip_writer := zip.NewWriter(w)
+	if c.method == zip.Deflate && c.level != 0 {
+		level := c.level
+		zip_writer.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+	}
+	return zip_writer
+}
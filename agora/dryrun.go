@@ -0,0 +1,88 @@
+package agora
+
+import (
+	"archive/zip"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+func format_size(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func describe_target(agora_url string, target_folder_id int, exam_id int, series_id int) string {
+	targets := []string{}
+	if target_folder_id > 0 {
+		targets = append(targets, fmt.Sprintf("folder %d", target_folder_id))
+	}
+	if exam_id > 0 {
+		targets = append(targets, fmt.Sprintf("exam %d", exam_id))
+	}
+	if series_id > 0 {
+		targets = append(targets, fmt.Sprintf("series %d", series_id))
+	}
+	if len(targets) == 0 {
+		targets = append(targets, "no target")
+	}
+	return fmt.Sprintf("%s on %s", strings.Join(targets, ", "), agora_url)
+}
+
+// print_dry_run prints what an upload would do without contacting the server. The zip bundles are listed with the
+// uncompressed size of their content, therefore their chunk count is an upper bound.
+func print_dry_run(agora_url string, files_to_upload []UploadFile, bundles [][]UploadFile, bundler bundler, target_folder_id int, exam_id int, series_id int, json_import_file string, extract_zip bool) {
+	var total_size int64
+	total_files := 0
+	total_chunks := 0
+
+	logrus.Info("\nDry Run (nothing is uploaded):")
+	logrus.Info("-----------------")
+	logrus.Infof("Target: %s", describe_target(agora_url, target_folder_id, exam_id, series_id))
+	if json_import_file != "" {
+		logrus.Infof("Import json: %s", json_import_file)
+	}
+	if extract_zip {
+		logrus.Info("Archives will be extracted on the server")
+	}
+
+	logrus.Infof("\nFiles uploaded directly (%d):", len(files_to_upload))
+	for _, file := range files_to_upload {
+		chunks := nof_chunks(file.Size)
+		logrus.Infof("  %s > %s (%s, %d chunks)", file.SourcePath, file.TargetPath, format_size(file.Size), chunks)
+		total_size += file.Size
+		total_files++
+		total_chunks += chunks
+	}
+
+	logrus.Infof("\nBundles (%d, %s, grouped %s):", len(bundles), bundler, bundler.strategy)
+	for index, bundle := range bundles {
+		var bundle_size int64
+		for _, file := range bundle {
+			bundle_size += file.Size
+		}
+		chunks := nof_chunks(bundle_size)
+		logrus.Infof("  %s (%d files, %s uncompressed, max. %d chunks):", bundler.name(index), len(bundle), format_size(bundle_size), chunks)
+		for _, file := range bundle {
+			stored := ""
+			if bundler.format == BUNDLE_FORMAT_ZIP && bundler.compression.method_for(file) == zip.Store && bundler.compression.method != zip.Store {
+				stored = ", stored"
+			}
+			logrus.Infof("    %s > %s (%s%s)", file.SourcePath, file.TargetPath, format_size(file.Size), stored)
+		}
+		total_size += bundle_size
+		total_files += len(bundle)
+		total_chunks += chunks
+	}
+
+	logrus.Infof("\nTotal: %d files, %s, %d uploads, max. %d chunks", total_files, format_size(total_size), len(files_to_upload)+len(bundles), total_chunks)
+}
@@ -0,0 +1,187 @@
+package agora
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// EVENT_SCHEMA_VERSION is increased whenever a field of Event is changed or removed. Adding fields or event types
+// does not change the version.
+const EVENT_SCHEMA_VERSION = 1
+
+const (
+	EVENT_SCAN_STARTED    = "scan_started"
+	EVENT_FILE_QUEUED     = "file_queued"
+	EVENT_FILE_ZIPPED     = "file_zipped"
+	EVENT_BUNDLE_CREATED  = "bundle_created"
+	EVENT_FILE_STARTED    = "file_started"
+	EVENT_CHUNK_SENT      = "chunk_sent"
+	EVENT_FILE_VERIFIED   = "file_verified"
+	EVENT_FILE_FINISHED   = "file_finished"
+	EVENT_IMPORT_PROGRESS = "import_progress"
+	EVENT_COMPLETED       = "completed"
+	EVENT_ERROR           = "error"
+)
+
+type ImportProgressEvent struct {
+	State         int    `json:"state"`
+	StateName     string `json:"state_name"`
+	Progress      int    `json:"progress"`
+	TasksCount    int    `json:"tasks_count"`
+	TasksFinished int    `json:"tasks_finished"`
+	TasksError    int    `json:"tasks_error"`
+}
+
+// Event is a progress event of an upload. Only the fields which are relevant for the event type are set.
+type Event struct {
+	Version         int                  `json:"version"`
+	Type            string               `json:"type"`
+	Time            time.Time            `json:"time"`
+	Paths           []string             `json:"paths,omitempty"`
+	Worker          int                  `json:"worker,omitempty"`
+	SourcePath      string               `json:"source_path,omitempty"`
+	TargetPath      string               `json:"target_path,omitempty"`
+	Bundle          string               `json:"bundle,omitempty"`
+	Size            int64                `json:"size,omitempty"`
+	Files           int                  `json:"files,omitempty"`
+	Chunk           int                  `json:"chunk,omitempty"`
+	Chunks          int                  `json:"chunks,omitempty"`
+	Bytes           int64                `json:"bytes,omitempty"`
+	ImportPackageId int                  `json:"import_package_id,omitempty"`
+	Import          *ImportProgressEvent `json:"import,omitempty"`
+	Report          *Report              `json:"-"`
+	Success         *bool                `json:"success,omitempty"`
+	Error           string               `json:"error,omitempty"`
+}
+
+// Observer is notified about the progress of an upload. OnEvent is called concurrently by the upload workers, so it
+// has to be safe for concurrent use and should return quickly, since the upload waits for it.
+type Observer interface {
+	OnEvent(event Event)
+}
+
+// ObserverFunc allows to use an ordinary function as Observer
+type ObserverFunc func(event Event)
+
+func (f ObserverFunc) OnEvent(event Event) {
+	f(event)
+}
+
+// ChannelObserver sends all events to a channel. The channel has to be drained, otherwise the upload blocks.
+func ChannelObserver(ch chan<- Event) Observer {
+	return ObserverFunc(func(event Event) {
+		ch <- event
+	})
+}
+
+type ndjsonObserver struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewNdjsonObserver returns an observer which writes the events as newline delimited json
+func NewNdjsonObserver(w io.Writer) Observer {
+	return &ndjsonObserver{encoder: json.NewEncoder(w)}
+}
+
+func (o *ndjsonObserver) OnEvent(event Event) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	// a broken event consumer must not break the upload, therefore write errors are ignored
+	o.encoder.Encode(event)
+}
+
+// notifier distributes the events to all observers. All methods can be called on a nil notifier, in which case
+// they do nothing.
+type notifier struct {
+	observers []Observer
+}
+
+func new_notifier(observers ...Observer) *notifier {
+	n := &notifier{}
+	for _, observer := range observers {
+		if observer != nil {
+			n.observers = append(n.observers, observer)
+		}
+	}
+	if len(n.observers) == 0 {
+		return nil
+	}
+	return n
+}
+
+func (n *notifier) emit(event Event) {
+	if n == nil {
+		return
+	}
+	event.Version = EVENT_SCHEMA_VERSION
+	event.Time = time.Now()
+	for _, observer := range n.observers {
+		observer.OnEvent(event)
+	}
+}
+
+func (n *notifier) scan_started(paths []string) {
+	n.emit(Event{Type: EVENT_SCAN_STARTED, Paths: paths})
+}
+
+func (n *notifier) file_queued(file UploadFile) {
+	n.emit(Event{Type: EVENT_FILE_QUEUED, SourcePath: file.SourcePath, TargetPath: file.TargetPath, Bundle: file.Bundle, Size: file.Size})
+}
+
+func (n *notifier) file_zipped(file UploadFile) {
+	n.emit(Event{Type: EVENT_FILE_ZIPPED, SourcePath: file.SourcePath, TargetPath: file.TargetPath, Bundle: file.Bundle, Size: file.Size})
+}
+
+func (n *notifier) bundle_created(name string, files int, size int64) {
+	n.emit(Event{Type: EVENT_BUNDLE_CREATED, Bundle: name, Files: files, Size: size})
+}
+
+// the workers are numbered from 0 internally, but 1-based in the events
+func (n *notifier) file_started(worker int, file UploadFile, size int64, chunks int) {
+	n.emit(Event{Type: EVENT_FILE_STARTED, Worker: worker + 1, SourcePath: file.SourcePath, TargetPath: file.TargetPath, Size: size, Chunks: chunks})
+}
+
+func (n *notifier) chunk_sent(worker int, file UploadFile, chunk int, chunks int, bytes int64) {
+	n.emit(Event{Type: EVENT_CHUNK_SENT, Worker: worker + 1, SourcePath: file.SourcePath, TargetPath: file.TargetPath, Chunk: chunk, Chunks: chunks, Bytes: bytes})
+}
+
+func (n *notifier) file_verified(worker int, file UploadFile, err error) {
+	success := err == nil
+	event := Event{Type: EVENT_FILE_VERIFIED, Worker: worker + 1, SourcePath: file.SourcePath, TargetPath: file.TargetPath, Success: &success}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	n.emit(event)
+}
+
+func (n *notifier) file_finished(worker int, file UploadFile, err error) {
+	success := err == nil
+	event := Event{Type: EVENT_FILE_FINISHED, Worker: worker + 1, SourcePath: file.SourcePath, TargetPath: file.TargetPath, Success: &success}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	n.emit(event)
+}
+
+func (n *notifier) import_progress(import_package_id int, progress UploadProgress) {
+	n.emit(Event{Type: EVENT_IMPORT_PROGRESS, ImportPackageId: import_package_id, Import: &ImportProgressEvent{
+		State:         int(progress.State),
+		StateName:     progress.State.String(),
+		Progress:      progress.Progress,
+		TasksCount:    progress.Tasks.Count,
+		TasksFinished: progress.Tasks.Finished,
+		TasksError:    progress.Tasks.Error,
+	}})
+}
+
+func (n *notifier) completed(report *Report) {
+	success := report.Success
+	n.emit(Event{Type: EVENT_COMPLETED, ImportPackageId: report.ImportPackageId, Files: len(report.Files), Report: report, Success: &success, Error: report.Error})
+}
+
+func (n *notifier) error(source_path string, err error) {
+	n.emit(Event{Type: EVENT_ERROR, SourcePath: source_path, Error: err.Error()})
+}
@@ -0,0 +1,100 @@
+package agora
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+type DataFilePage struct {
+	Count   int        `json:"count"`
+	Next    string     `json:"next"`
+	Results []DataFile `json:"results"`
+}
+
+// get_existing_datafiles returns all datafiles in the target exam or, if no exam is given, in the target folder.
+// The endpoint can either return a plain list or a paginated result.
+func get_existing_datafiles(agora_url string, api_key string, target_folder_id int, exam_id int) ([]DataFile, error) {
+	var request_url string
+	if exam_id > 0 {
+		request_url = join_url(agora_url, fmt.Sprintf("/api/v1/exam/%d/datafiles/", exam_id)) + "/"
+	} else if target_folder_id > 0 {
+		request_url = join_url(agora_url, fmt.Sprintf("/api/v1/folder/%d/datafiles/", target_folder_id)) + "/"
+	} else {
+		return nil, fmt.Errorf("\"--skip-existing\" requires a target folder or exam")
+	}
+
+	datafiles := []DataFile{}
+	for request_url != "" {
+		response, err := GetRequest(request_url, api_key, "", "")
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("could not get the datafiles of the target. http status = %d", response.StatusCode)
+		}
+
+		if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+			var page []DataFile
+			if err := json.Unmarshal(body, &page); err != nil {
+				return nil, err
+			}
+			datafiles = append(datafiles, page...)
+			break
+		}
+		var page DataFilePage
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+		datafiles = append(datafiles, page.Results...)
+		request_url = page.Next
+	}
+	return datafiles, nil
+}
+
+func filter_existing(files []UploadFile, existing map[string]int) ([]UploadFile, []UploadFile) {
+	remaining := []UploadFile{}
+	skipped := []UploadFile{}
+	for _, file := range files {
+		_, localSha1, err := file.content_hashes()
+		if err != nil {
+			logrus.Warningf("could not calculate the hash of %s, it will be uploaded: %v", file.SourcePath, err)
+			remaining = append(remaining, file)
+			continue
+		}
+		if datafile_id, ok := existing[localSha1]; ok {
+			logrus.Debugf("skipping %s: the file already exists in the target", file.SourcePath)
+			file.DataFileId = datafile_id
+			skipped = append(skipped, file)
+			continue
+		}
+		remaining = append(remaining, file)
+	}
+	return remaining, skipped
+}
+
+// skip_existing removes the files whose content is already present in the datafiles. It returns the remaining files
+// and the skipped ones.
+func skip_existing(files_to_upload []UploadFile, files_to_zip []UploadFile, datafiles []DataFile) ([]UploadFile, []UploadFile, []UploadFile) {
+	existing := make(map[string]int)
+	for _, datafile := range datafiles {
+		if datafile.Sha1 != "" {
+			existing[datafile.Sha1] = datafile.ID
+		}
+	}
+
+	files_to_upload, skipped_uploads := filter_existing(files_to_upload, existing)
+	files_to_zip, skipped_zips := filter_existing(files_to_zip, existing)
+	skipped := append(skipped_uploads, skipped_zips...)
+	logrus.Infof("Skipping %d files which already exist in the target", len(skipped))
+	return files_to_upload, files_to_zip, skipped
+}
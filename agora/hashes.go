@@ -0,0 +1,93 @@
+package agora
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+)
+
+// fileHashes caches the hashes of a file. They are computed while the file is read for the upload or for a bundle,
+// so a file is only read once. All copies of an UploadFile share the same fileHashes.
+type fileHashes struct {
+	sha256 string
+	sha1   string
+}
+
+// hashingReader computes the sha256 and the sha1 of everything which is read through it
+type hashingReader struct {
+	r      io.Reader
+	sha256 hash.Hash
+	sha1   hash.Hash
+}
+
+func new_hashing_reader(r io.Reader) *hashingReader {
+	return &hashingReader{r: r, sha256: sha256.New(), sha1: sha1.New()}
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.sha256.Write(p[:n])
+	h.sha1.Write(p[:n])
+	return n, err
+}
+
+func (h *hashingReader) sums() (string, string) {
+	return hex.EncodeToString(h.sha256.Sum(nil)), hex.EncodeToString(h.sha1.Sum(nil))
+}
+
+// store caches the hashes in the file. It must only be called once the whole file was read.
+func (h *hashingReader) store(file UploadFile) {
+	if file.hashes != nil {
+		file.hashes.sha256, file.hashes.sha1 = h.sums()
+	}
+}
+
+func hash_file(path string) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	h := new_hashing_reader(f)
+	if _, err := io.Copy(io.Discard, h); err != nil {
+		return "", "", err
+	}
+	sha256, sha1 := h.sums()
+	return sha256, sha1, nil
+}
+
+// content_hashes returns the sha256 and the sha1 of a file. The file is only read if it was not read before.
+func (f UploadFile) content_hashes() (string, string, error) {
+	if f.hashes != nil && f.hashes.sha256 != "" {
+		return f.hashes.sha256, f.hashes.sha1, nil
+	}
+	sha256, sha1, err := hash_file(f.SourcePath)
+	if err != nil {
+		return "", "", err
+	}
+	if f.hashes != nil {
+		f.hashes.sha256, f.hashes.sha1 = sha256, sha1
+	}
+	return sha256, sha1, nil
+}
+
+// cached_hashes returns the hashes of a file if it was already read, or empty strings otherwise
+func (f UploadFile) cached_hashes() (string, string) {
+	if f.hashes == nil {
+		return "", ""
+	}
+	return f.hashes.sha256, f.hashes.sha1
+}
+
+// init_hashes gives every file a cache for its hashes
+func init_hashes(files []UploadFile) {
+	for i := range files {
+		if files[i].hashes == nil {
+			files[i].hashes = &fileHashes{}
+		}
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package agora
+
+import (
+	"os"
+)
+
+// lock_file creates a lock file, which must not exist yet. It returns false if another process holds the lock. The
+// lock file of a process which has crashed has to be removed by hand.
+func lock_file(path string) (*os.File, bool, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+	if os.IsExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return f, true, nil
+}
+
+func unlock_file(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
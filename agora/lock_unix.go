@@ -0,0 +1,32 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package agora
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lock_file takes an exclusive lock on a file, which is created if necessary. It returns false if another process
+// holds the lock. The lock is released by unlock_file, or by the system if the process ends.
+func lock_file(path string) (*os.File, bool, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return f, true, nil
+}
+
+func unlock_file(f *os.File) {
+	unix.Flock(int(f.Fd()), unix.LOCK_UN)
+	f.Close()
+}
@@ -0,0 +1,68 @@
+package agora
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// XATTR_EXTRA_ID is the id of the zip extra field which holds the extended attributes of a file. The field contains
+// a list of attributes, each encoded as: name length (uint16), name, value length (uint16), value (little endian).
+const XATTR_EXTRA_ID = 0x7861
+
+// the data of a zip extra field is limited to 64 KB, including the other extra fields
+const maxXattrExtraSize = 32 * 1024
+
+func append_uint16(data []byte, value uint16) []byte {
+	return append(data, byte(value), byte(value>>8))
+}
+
+func format_mode(mode os.FileMode) string {
+	return fmt.Sprintf("%#o", mode.Perm())
+}
+
+// encode_xattrs encodes the extended attributes as zip extra field. It returns nil if there are none or if they
+// don't fit into an extra field.
+func encode_xattrs(xattrs map[string][]byte) []byte {
+	if len(xattrs) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(xattrs))
+	for name := range xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	data := []byte{}
+	for _, name := range names {
+		value := xattrs[name]
+		data = append_uint16(data, uint16(len(name)))
+		data = append(data, name...)
+		data = append_uint16(data, uint16(len(value)))
+		data = append(data, value...)
+	}
+	if len(data) > maxXattrExtraSize {
+		return nil
+	}
+	extra := append_uint16(nil, XATTR_EXTRA_ID)
+	extra = append_uint16(extra, uint16(len(data)))
+	return append(extra, data...)
+}
+
+// collect_xattrs reads the extended attributes of the files
+func collect_xattrs(files []UploadFile) {
+	for i := range files {
+		xattrs, err := read_xattrs(files[i].SourcePath)
+		if err != nil {
+			logrus.Warningf("could not read the extended attributes of %s: %v", files[i].SourcePath, err)
+			continue
+		}
+		if len(xattrs) > 0 && encode_xattrs(xattrs) == nil {
+			logrus.Warningf("the extended attributes of %s are too large and will not be preserved", files[i].SourcePath)
+			continue
+		}
+		files[i].Xattrs = xattrs
+	}
+}
@@ -0,0 +1,252 @@
+package agora
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/term"
+)
+
+const progressBarWidth = 30
+const progressRefreshInterval = 200 * time.Millisecond
+
+type workerProgress struct {
+	name string
+	sent int64
+	size int64
+}
+
+// progressDisplay is an observer which draws live progress bars on stderr. While it is running it also acts as the
+// output of logrus, so log messages are printed above the progress bars instead of overwriting them.
+type progressDisplay struct {
+	mutex    sync.Mutex
+	out      *os.File
+	previous io.Writer
+	lines    int
+	stopCh   chan bool
+	doneCh   chan bool
+
+	start_time time.Time
+	total      int64
+	sent       int64
+	rate       float64
+	last_sent  int64
+	last_time  time.Time
+
+	files_to_zip  int
+	files_zipped  int
+	bundles       int
+	bundle_sizes  map[string]int64
+	workers       []workerProgress
+	import_active bool
+	import_state  ImportProgressEvent
+}
+
+// ProgressSupported returns true if stderr is a terminal, i.e. if progress bars can be drawn
+func ProgressSupported() bool {
+	return term.IsTerminal(int(os.Stderr.Fd()))
+}
+
+func new_progress_display(workers int) *progressDisplay {
+	return &progressDisplay{
+		out:          os.Stderr,
+		bundle_sizes: make(map[string]int64),
+		workers:      make([]workerProgress, workers),
+	}
+}
+
+func (p *progressDisplay) start() {
+	p.start_time = time.Now()
+	p.last_time = p.start_time
+	p.stopCh = make(chan bool)
+	p.doneCh = make(chan bool)
+	p.previous = logrus.StandardLogger().Out
+	logrus.SetOutput(p)
+
+	go func() {
+		ticker := time.NewTicker(progressRefreshInterval)
+		defer ticker.Stop()
+		defer close(p.doneCh)
+		for {
+			select {
+			case <-ticker.C:
+				p.mutex.Lock()
+				p.redraw()
+				p.mutex.Unlock()
+			case <-p.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (p *progressDisplay) stop() {
+	if p.stopCh == nil {
+		return
+	}
+	close(p.stopCh)
+	<-p.doneCh
+	p.stopCh = nil
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.redraw()
+	p.lines = 0
+	logrus.SetOutput(p.previous)
+}
+
+// Write prints a log message above the progress bars
+func (p *progressDisplay) Write(b []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.clear()
+	n, err := p.out.Write(b)
+	p.redraw()
+	return n, err
+}
+
+func (p *progressDisplay) OnEvent(event Event) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	switch event.Type {
+	case EVENT_FILE_QUEUED:
+		// bundles are estimated with the uncompressed size of their files until they are created
+		p.total += event.Size
+		if event.Bundle != "" {
+			p.files_to_zip++
+			p.bundle_sizes[event.Bundle] += event.Size
+		}
+	case EVENT_FILE_ZIPPED:
+		p.files_zipped++
+	case EVENT_BUNDLE_CREATED:
+		p.bundles++
+		p.total += event.Size - p.bundle_sizes[event.Bundle]
+	case EVENT_FILE_STARTED:
+		p.workers[event.Worker-1] = workerProgress{name: event.TargetPath, size: event.Size}
+	case EVENT_CHUNK_SENT:
+		p.workers[event.Worker-1].sent += event.Bytes
+		p.sent += event.Bytes
+	case EVENT_FILE_FINISHED:
+		p.workers[event.Worker-1] = workerProgress{}
+	case EVENT_IMPORT_PROGRESS:
+		p.import_active = true
+		p.import_state = *event.Import
+	}
+}
+
+func progress_bar(fraction float64) string {
+	if fraction < 0 {
+		fraction = 0
+	} else if fraction > 1 {
+		fraction = 1
+	}
+	filled := int(fraction * progressBarWidth)
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+	return fmt.Sprintf("[%s] %3d%%", bar, int(fraction*100))
+}
+
+func format_duration(d time.Duration) string {
+	d = d.Round(time.Second)
+	h := d / time.Hour
+	m := (d % time.Hour) / time.Minute
+	s := (d % time.Minute) / time.Second
+	if h > 0 {
+		return fmt.Sprintf("%dh%02dm%02ds", h, m, s)
+	}
+	return fmt.Sprintf("%dm%02ds", m, s)
+}
+
+func (p *progressDisplay) update_rate() {
+	now := time.Now()
+	elapsed := now.Sub(p.last_time).Seconds()
+	if elapsed < 1 {
+		return
+	}
+	current := float64(p.sent-p.last_sent) / elapsed
+	if p.rate == 0 {
+		p.rate = current
+	} else {
+		// exponential moving average, so the throughput and the ETA don't jump around
+		p.rate = 0.7*p.rate + 0.3*current
+	}
+	p.last_sent = p.sent
+	p.last_time = now
+}
+
+func (p *progressDisplay) render() []string {
+	p.update_rate()
+	lines := []string{}
+
+	fraction := 1.0
+	if p.total > 0 {
+		fraction = float64(p.sent) / float64(p.total)
+	}
+	eta := "--"
+	if p.rate > 0 && p.total > p.sent {
+		eta = format_duration(time.Duration(float64(p.total-p.sent) / p.rate * float64(time.Second)))
+	}
+	lines = append(lines, fmt.Sprintf("Uploading  %s  %s / %s  %s/s  ETA %s", progress_bar(fraction), format_size(p.sent), format_size(p.total), format_size(int64(p.rate)), eta))
+
+	if p.files_to_zip > 0 {
+		lines = append(lines, fmt.Sprintf("Zipping    %s  %d/%d files, %d bundles", progress_bar(float64(p.files_zipped)/float64(p.files_to_zip)), p.files_zipped, p.files_to_zip, p.bundles))
+	}
+
+	for i, worker := range p.workers {
+		if worker.name == "" {
+			lines = append(lines, fmt.Sprintf("  #%d idle", i+1))
+			continue
+		}
+		worker_fraction := 1.0
+		if worker.size > 0 {
+			worker_fraction = float64(worker.sent) / float64(worker.size)
+		}
+		lines = append(lines, fmt.Sprintf("  #%d %3d%%  %s", i+1, int(worker_fraction*100), filepath.Base(worker.name)))
+	}
+
+	if p.import_active {
+		lines = append(lines, fmt.Sprintf("Importing  %s  %d/%d tasks", progress_bar(float64(p.import_state.Progress)/100), p.import_state.TasksFinished, p.import_state.TasksCount))
+	}
+	return lines
+}
+
+func (p *progressDisplay) clear() {
+	if p.lines == 0 {
+		return
+	}
+	// move the cursor to the first line of the progress bars and clear everything below
+	fmt.Fprintf(p.out, "\033[%dA\r\033[J", p.lines)
+	p.lines = 0
+}
+
+func (p *progressDisplay) redraw() {
+	width := 0
+	if w, _, err := term.GetSize(int(p.out.Fd())); err == nil {
+		width = w
+	}
+
+	var b bytes.Buffer
+	lines := p.render()
+	if p.lines > 0 {
+		fmt.Fprintf(&b, "\033[%dA\r\033[J", p.lines)
+	}
+	for _, line := range lines {
+		if width > 0 && len(line) >= width {
+			line = line[:width-1]
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	p.out.Write(b.Bytes())
+	p.lines = len(lines)
+}
@@ -0,0 +1,46 @@
+package agora
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestMatchesNoProxy(t *testing.T) {
+	tests := []struct {
+		name     string
+		no_proxy string
+		url      string
+		want     bool
+	}{
+		{"empty list", "", "https://agora.example.com", false},
+		{"exact host", "agora.example.com", "https://agora.example.com/api/v1/", true},
+		{"other host", "agora.example.com", "https://other.example.com", false},
+		{"host is case insensitive", "Agora.Example.COM", "https://agora.example.com", true},
+		{"domain matches subdomains", "example.com", "https://agora.example.com", true},
+		{"domain matches itself", "example.com", "https://example.com", true},
+		{"domain does not match a suffix of a name", "example.com", "https://badexample.com", false},
+		{"leading dot", ".example.com", "https://agora.example.com", true},
+		{"leading dot matches the domain", ".example.com", "https://example.com", true},
+		{"leading wildcard", "*.example.com", "https://agora.example.com", true},
+		{"wildcard matches all hosts", "*", "https://agora.example.com", true},
+		{"matching port", "agora.example.com:8443", "https://agora.example.com:8443", true},
+		{"other port", "agora.example.com:8443", "https://agora.example.com", false},
+		{"ip", "10.0.0.1", "http://10.0.0.1:8000", true},
+		{"cidr", "10.0.0.0/8", "http://10.1.2.3", true},
+		{"cidr does not match other networks", "10.0.0.0/8", "http://192.168.1.1", false},
+		{"cidr does not match host names", "10.0.0.0/8", "http://agora.example.com", false},
+		{"list with spaces", "localhost, 127.0.0.1 ,example.com", "https://agora.example.com", true},
+		{"empty entries are ignored", ",,", "https://agora.example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request_url, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := matches_no_proxy(request_url, parse_no_proxy(tt.no_proxy)); got != tt.want {
+				t.Errorf("matches_no_proxy(%q, %q) = %v, want %v", tt.url, tt.no_proxy, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,384 @@
+package agora
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	JOB_STATUS_PENDING = "pending"
+	JOB_STATUS_FAILED  = "failed"
+)
+
+// DEFAULT_QUEUE_POLL_INTERVAL is the interval in which the queue is checked, if no interval is set
+const DEFAULT_QUEUE_POLL_INTERVAL = 1 * time.Minute
+
+// the retry delay of a job is doubled after every failed attempt, up to this limit
+const QUEUE_MAX_RETRY_DELAY = 1 * time.Hour
+
+// Job is an upload in the queue. Every job is stored as a json file in the queue folder.
+type Job struct {
+	ID             string    `json:"id"`
+	Created        time.Time `json:"created"`
+	Url            string    `json:"url"`
+	Paths          []string  `json:"paths"`
+	TargetFolderId int       `json:"target_folder_id"`
+	JsonImportFile string    `json:"import_json,omitempty"`
+	ExtractZip     bool      `json:"extract_zip,omitempty"`
+	Verify         bool      `json:"verify,omitempty"`
+	SkipExisting   bool      `json:"skip_existing,omitempty"`
+
+	Status          string    `json:"status"`
+	Attempts        int       `json:"attempts"`
+	LastAttempt     time.Time `json:"last_attempt"`
+	NextAttempt     time.Time `json:"next_attempt"`
+	LastError       string    `json:"last_error,omitempty"`
+	ImportPackageId int       `json:"import_package_id,omitempty"`
+	// Completed is true once the import package of the job was completed. The files are not uploaded again, only the
+	// import is checked.
+	Completed bool `json:"completed,omitempty"`
+}
+
+type QueueOptions struct {
+	// the folder is checked for new jobs and the servers are pinged with this interval. 0 selects
+	// DEFAULT_QUEUE_POLL_INTERVAL.
+	PollInterval time.Duration
+	// the delay before the first retry of a failed job
+	RetryDelay time.Duration
+	// a job is marked as failed after MaxAttempts failed uploads (0 = no limit)
+	MaxAttempts int
+	// Once drains the queue and returns instead of waiting for new jobs
+	Once bool
+}
+
+// Queue is a durable queue of uploads, stored in a folder
+type Queue struct {
+	Dir string
+}
+
+// DefaultQueueDir returns the folder of the queue in the home directory of the user
+func DefaultQueueDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.TempDir()
+	}
+	return filepath.Join(home, ".agora-uploader", "queue")
+}
+
+func OpenQueue(dir string) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create the queue folder %s: %w", dir, err)
+	}
+	return &Queue{Dir: dir}, nil
+}
+
+func (q *Queue) job_path(id string) string {
+	return filepath.Join(q.Dir, id+".json")
+}
+
+// the lock file of a job is locked while the job runs, so two processes which run the same queue never run the same
+// job at the same time
+func (q *Queue) lock_path(id string) string {
+	return filepath.Join(q.Dir, id+".lock")
+}
+
+func load_job(path string) (*Job, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// save writes the job to a temporary file first, so an interrupted write never leaves a broken job behind
+func (q *Queue) save(job *Job) error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp_path := q.job_path(job.ID) + ".tmp"
+	if err := ioutil.WriteFile(temp_path, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp_path, q.job_path(job.ID))
+}
+
+// Add adds a job to the queue. The paths are stored as absolute paths.
+func (q *Queue) Add(job Job) (*Job, error) {
+	if len(job.Paths) == 0 {
+		return nil, fmt.Errorf("the job has no paths to upload")
+	}
+	for i, path := range job.Paths {
+		abs_path, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(abs_path); err != nil {
+			return nil, err
+		}
+		job.Paths[i] = abs_path
+	}
+	job.Created = time.Now()
+	job.ID = job.Created.Format("20060102-150405") + "-" + generateUUID()[:8]
+	job.Status = JOB_STATUS_PENDING
+	if err := q.save(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Jobs returns all jobs in the queue, the oldest first
+func (q *Queue) Jobs() ([]*Job, error) {
+	entries, err := ioutil.ReadDir(q.Dir)
+	if err != nil {
+		return nil, err
+	}
+	jobs := []*Job{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		job, err := load_job(filepath.Join(q.Dir, entry.Name()))
+		if os.IsNotExist(err) {
+			// the job could have been removed in the meantime
+			continue
+		}
+		if err != nil {
+			logrus.Warningf("skipping the invalid job %s: %v", entry.Name(), err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs, nil
+}
+
+// Remove removes the job with the given ID. A unique prefix of the ID is sufficient.
+func (q *Queue) Remove(id string) (string, error) {
+	jobs, err := q.Jobs()
+	if err != nil {
+		return "", err
+	}
+	matches := []string{}
+	for _, job := range jobs {
+		if job.ID == id {
+			matches = []string{job.ID}
+			break
+		}
+		if strings.HasPrefix(job.ID, id) {
+			matches = append(matches, job.ID)
+		}
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no job with the ID %s found", id)
+	} else if len(matches) > 1 {
+		return "", fmt.Errorf("the ID %s is ambiguous: %s", id, strings.Join(matches, ", "))
+	}
+	if err := os.Remove(q.job_path(matches[0])); err != nil {
+		return "", err
+	}
+	os.Remove(q.lock_path(matches[0]))
+	return matches[0], nil
+}
+
+// update saves a job after it was run. A job which was removed while it was running is not written back.
+func (q *Queue) update(job *Job) error {
+	if _, err := os.Stat(q.job_path(job.ID)); os.IsNotExist(err) {
+		logrus.Infof("Job %s was removed from the queue while it was running", job.ID)
+		return nil
+	}
+	return q.save(job)
+}
+
+func retry_delay(delay time.Duration, attempts int) time.Duration {
+	for i := 1; i < attempts && delay < QUEUE_MAX_RETRY_DELAY; i++ {
+		delay *= 2
+	}
+	if delay > QUEUE_MAX_RETRY_DELAY {
+		delay = QUEUE_MAX_RETRY_DELAY
+	}
+	return delay
+}
+
+// run_job uploads a job and returns true if it has finished
+func (q *Queue) run_job(ctx context.Context, job *Job, api_key string, options QueueOptions) (bool, error) {
+	logrus.Infof("Running job %s (attempt %d): %s", job.ID, job.Attempts+1, strings.Join(job.Paths, ", "))
+	upload_options := UploadOptions{
+		TargetFolderId: job.TargetFolderId,
+		JsonImportFile: job.JsonImportFile,
+		ExtractZip:     job.ExtractZip,
+		Wait:           true,
+		Verify:         job.Verify,
+		SkipExisting:   job.SkipExisting,
+	}
+	paths := job.Paths
+	scan := func() ([]UploadFile, []UploadFile, bool) {
+		return analyse_paths(paths)
+	}
+	var report *Report
+	var err error
+	if job.Completed {
+		logrus.Infof("The import package %d of job %s is already complete, checking the import", job.ImportPackageId, job.ID)
+		report, err = check_import(ctx, job.Url, api_key, job.ImportPackageId, scan, upload_options)
+	} else {
+		report, err = run_upload(ctx, job.Url, api_key, paths, scan, upload_options)
+	}
+	if report != nil && report.Completed {
+		job.ImportPackageId = report.ImportPackageId
+		job.Completed = true
+	}
+	if ctx.Err() != nil {
+		// an interrupted job is not an attempt, it is run again with the next start of the queue
+		logrus.Infof("Job %s was interrupted", job.ID)
+		if job.Completed {
+			return false, q.update(job)
+		}
+		return false, nil
+	}
+
+	job.Attempts++
+	job.LastAttempt = time.Now()
+	if report != nil && report.ImportPackageId > 0 {
+		job.ImportPackageId = report.ImportPackageId
+	}
+	if err == nil && (report == nil || !report.Success) {
+		// a job whose files were not all uploaded is not finished
+		err = errors.New("not all files were uploaded")
+	}
+	if err == nil {
+		logrus.Infof("Job %s finished (import package %d)", job.ID, job.ImportPackageId)
+		if err := os.Remove(q.job_path(job.ID)); err != nil && !os.IsNotExist(err) {
+			return true, err
+		}
+		os.Remove(q.lock_path(job.ID))
+		return true, nil
+	}
+
+	job.LastError = err.Error()
+	if job.Completed && report != nil && report.Progress.State.is_final() {
+		// the import has ended on the server, uploading the files again would import them twice
+		job.Status = JOB_STATUS_FAILED
+		logrus.Errorf("Job %s failed, the import %d has ended: %v", job.ID, job.ImportPackageId, err)
+	} else if options.MaxAttempts > 0 && job.Attempts >= options.MaxAttempts {
+		job.Status = JOB_STATUS_FAILED
+		logrus.Errorf("Job %s failed after %d attempts: %v", job.ID, job.Attempts, err)
+	} else {
+		delay := retry_delay(options.RetryDelay, job.Attempts)
+		job.NextAttempt = job.LastAttempt.Add(delay)
+		logrus.Errorf("Job %s failed, retrying in %v: %v", job.ID, delay, err)
+	}
+	return false, q.update(job)
+}
+
+// run_locked runs a job while its lock is held. It returns false if the job is run by another process, or if it was
+// run or removed by another process since it was listed.
+func (q *Queue) run_locked(ctx context.Context, job *Job, api_key string, options QueueOptions) (*Job, bool, error) {
+	lock, locked, err := lock_file(q.lock_path(job.ID))
+	if err != nil {
+		return job, false, fmt.Errorf("could not lock the job %s: %w", job.ID, err)
+	}
+	if !locked {
+		logrus.Debugf("job %s is run by another process", job.ID)
+		return job, false, nil
+	}
+	defer unlock_file(lock)
+
+	current, err := load_job(q.job_path(job.ID))
+	if err != nil {
+		// the job was finished or removed in the meantime
+		return job, false, nil
+	}
+	if current.Status != JOB_STATUS_PENDING || time.Now().Before(current.NextAttempt) {
+		return current, false, nil
+	}
+	finished, err := q.run_job(ctx, current, api_key, options)
+	return current, finished, err
+}
+
+// drain runs all pending jobs which are due and whose server is reachable. It returns the number of jobs which are
+// still pending.
+func (q *Queue) drain(ctx context.Context, api_key string, options QueueOptions) (int, error) {
+	jobs, err := q.Jobs()
+	if err != nil {
+		return 0, err
+	}
+	reachable := make(map[string]bool)
+	nof_pending := 0
+	for _, job := range jobs {
+		if ctx.Err() != nil {
+			return nof_pending, nil
+		}
+		if job.Status != JOB_STATUS_PENDING {
+			continue
+		}
+		nof_pending++
+		if time.Now().Before(job.NextAttempt) {
+			continue
+		}
+		online, checked := reachable[job.Url]
+		if !checked {
+			online, err = Ping(job.Url)
+			if !online {
+				logrus.Debugf("%s is not reachable: %v", job.Url, err)
+			}
+			reachable[job.Url] = online
+		}
+		if !online {
+			continue
+		}
+		job, finished, err := q.run_locked(ctx, job, api_key, options)
+		if err != nil {
+			logrus.Errorf("could not update the job %s: %v", job.ID, err)
+		}
+		if finished || job.Status == JOB_STATUS_FAILED {
+			nof_pending--
+		}
+	}
+	return nof_pending, nil
+}
+
+// Run uploads the jobs in the queue as soon as their server is reachable. It runs until the context is cancelled,
+// or with Once until no job is due anymore.
+func (q *Queue) Run(ctx context.Context, api_key string, options QueueOptions) error {
+	logrus.Infof("Processing the upload queue in %s", q.Dir)
+	if options.PollInterval <= 0 {
+		options.PollInterval = DEFAULT_QUEUE_POLL_INTERVAL
+	}
+	ticker := time.NewTicker(options.PollInterval)
+	defer ticker.Stop()
+	for {
+		nof_pending, err := q.drain(ctx, api_key, options)
+		if err != nil {
+			return err
+		}
+		if options.Once {
+			if nof_pending > 0 {
+				return fmt.Errorf("%d jobs are still pending", nof_pending)
+			}
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			logrus.Info("Stopped processing the upload queue")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package agora
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+const (
+	UPLOAD_STATUS_PLANNED  = "planned"
+	UPLOAD_STATUS_UPLOADED = "uploaded"
+	UPLOAD_STATUS_FAILED   = "failed"
+	UPLOAD_STATUS_SKIPPED  = "skipped"
+)
+
+type FileReport struct {
+	SourcePath     string            `json:"source_path"`
+	TargetPath     string            `json:"target_path"`
+	Size           int64             `json:"size"`
+	ModTime        time.Time         `json:"mtime"`
+	Mode           string            `json:"mode"`
+	Xattrs         map[string][]byte `json:"xattrs,omitempty"`
+	Sha256         string            `json:"sha256,omitempty"`
+	Sha1           string            `json:"sha1,omitempty"`
+	Bundle         string            `json:"bundle,omitempty"`
+	Status         string            `json:"status"`
+	Retries        int               `json:"retries"`
+	UploadDuration float64           `json:"upload_duration"`
+	DataFileId     int               `json:"datafile_id,omitempty"`
+	ImportStatus   string            `json:"import_status,omitempty"`
+	Error          string            `json:"error,omitempty"`
+}
+
+// is_processed returns true if the file is present in the target: it was skipped because it already exists there,
+// or it was imported. An uploaded file whose import was not verified only counts if the upload was handed_over.
+func (f FileReport) is_processed(handed_over bool) bool {
+	switch {
+	case f.Status == UPLOAD_STATUS_SKIPPED:
+		return true
+	case f.Status != UPLOAD_STATUS_UPLOADED:
+		return false
+	case f.ImportStatus == IMPORT_STATUS_IMPORTED:
+		return true
+	}
+	return f.ImportStatus == "" && handed_over
+}
+
+// Report summarizes an upload. Durations are in seconds. For zipped files the retries, the duration and the error
+// are the ones of the bundle the file was uploaded in.
+type Report struct {
+	Url             string         `json:"url"`
+	ImportPackageId int            `json:"import_package_id,omitempty"`
+	TargetFolderId  int            `json:"target_folder_id,omitempty"`
+	ExamId          int            `json:"exam_id,omitempty"`
+	SeriesId        int            `json:"series_id,omitempty"`
+	DryRun          bool           `json:"dry_run"`
+	StartTime       time.Time      `json:"start_time"`
+	Duration        float64        `json:"duration"`
+	Success         bool           `json:"success"`
+	Error           string         `json:"error,omitempty"`
+	Progress        UploadProgress `json:"progress"`
+	ImportState     string         `json:"import_state,omitempty"`
+	Files           []FileReport   `json:"files"`
+	// Completed is true once the import package was completed. Its files were handed over to the server and the
+	// import continues there, even if the upload fails afterwards (e.g. the wait for the import is interrupted).
+	Completed bool `json:"completed"`
+
+	mutex   sync.Mutex
+	files   []UploadFile
+	skipped []UploadFile
+	uploads map[string]uploadResult
+	// the files which were left out of their bundle
+	skipped_files map[string]error
+	// on_failure is called when a file or bundle could not be uploaded or a file was left out of its bundle
+	on_failure func()
+}
+
+type uploadResult struct {
+	retries  int
+	duration time.Duration
+	err      error
+}
+
+func new_report(agora_url string, options UploadOptions) *Report {
+	return &Report{
+		Url:            agora_url,
+		TargetFolderId: options.TargetFolderId,
+		ExamId:         options.ExamId,
+		SeriesId:       options.SeriesId,
+		DryRun:         options.DryRun,
+		StartTime:      time.Now(),
+		Files:          []FileReport{},
+		uploads:        make(map[string]uploadResult),
+		skipped_files:  make(map[string]error),
+	}
+}
+
+// add_upload records the result of an uploaded file or bundle. It is called concurrently by the upload workers.
+func (r *Report) add_upload(target_path string, retries int, duration time.Duration, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.uploads[target_path] = uploadResult{retries: retries, duration: duration, err: err}
+	if err != nil && r.on_failure != nil {
+		r.on_failure()
+	}
+}
+
+// handed_over returns true if the uploaded files are in the hands of the server: the upload succeeded, or the import
+// package was completed and the import did not fail, even if the upload failed afterwards (e.g. the wait for the
+// import was interrupted). A failed upload before that deletes its import package.
+func (r *Report) handed_over(upload_err error) bool {
+	return upload_err == nil || (r.Completed && !r.Progress.State.failed())
+}
+
+// skip_file records a file which was left out of its bundle. It is called concurrently by the upload workers.
+func (r *Report) skip_file(target_path string, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.skipped_files[target_path] = err
+	if r.on_failure != nil {
+		r.on_failure()
+	}
+}
+
+// nof_failed returns the number of files and bundles which could not be uploaded and of the files which were left
+// out of their bundle
+func (r *Report) nof_failed() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	n := len(r.skipped_files)
+	for _, result := range r.uploads {
+		if result.err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *Report) file_report(file UploadFile, status string) FileReport {
+	file_report := FileReport{
+		SourcePath:   file.SourcePath,
+		TargetPath:   file.TargetPath,
+		Size:         file.Size,
+		ModTime:      file.ModTime,
+		Mode:         format_mode(file.Mode),
+		Xattrs:       file.Xattrs,
+		Bundle:       file.Bundle,
+		Status:       status,
+		DataFileId:   file.DataFileId,
+		ImportStatus: file.ImportStatus,
+	}
+	// the hashes are only reported for files which were sent or found in the target folder. A file is never read
+	// just for the report, so planned and unsent files have no hashes.
+	if status == UPLOAD_STATUS_SKIPPED {
+		file_report.Sha256, file_report.Sha1 = file.cached_hashes()
+	}
+	if status != UPLOAD_STATUS_UPLOADED {
+		return file_report
+	}
+
+	upload_name := file.TargetPath
+	if file.Bundle != "" {
+		upload_name = file.Bundle
+	}
+	result, ok := r.uploads[upload_name]
+	if !ok {
+		file_report.Status = UPLOAD_STATUS_FAILED
+		file_report.Error = "the file was not uploaded"
+		return file_report
+	}
+	file_report.Retries = result.retries
+	file_report.UploadDuration = result.duration.Seconds()
+	if result.err != nil {
+		file_report.Status = UPLOAD_STATUS_FAILED
+		file_report.Error = result.err.Error()
+	} else if err, ok := r.skipped_files[file.TargetPath]; ok && file.Bundle != "" {
+		file_report.Status = UPLOAD_STATUS_FAILED
+		file_report.Error = err.Error()
+	} else {
+		file_report.Sha256, file_report.Sha1 = file.cached_hashes()
+	}
+	return file_report
+}
+
+func (r *Report) finish(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	status := UPLOAD_STATUS_UPLOADED
+	if r.DryRun {
+		status = UPLOAD_STATUS_PLANNED
+	}
+	r.Files = []FileReport{}
+	for _, file := range r.files {
+		r.Files = append(r.Files, r.file_report(file, status))
+	}
+	for _, file := range r.skipped {
+		r.Files = append(r.Files, r.file_report(file, UPLOAD_STATUS_SKIPPED))
+	}
+
+	r.Duration = time.Since(r.StartTime).Seconds()
+	r.Success = err == nil
+	if err != nil {
+		r.Error = err.Error()
+	}
+	for _, file := range r.Files {
+		if file.Status == UPLOAD_STATUS_FAILED {
+			r.Success = false
+		}
+	}
+}
+
+func (r *Report) Json() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+func (r *Report) Save(path string) error {
+	data, err := r.Json()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,85 @@
+package agora
+
+import "fmt"
+
+// ImportState is the state of an import package on the server
+type ImportState int
+
+const (
+	IMPORT_STATE_ERROR                ImportState = -1
+	IMPORT_STATE_CREATED              ImportState = 0
+	IMPORT_STATE_UPLOADING            ImportState = 1
+	IMPORT_STATE_UPLOADED             ImportState = 2
+	IMPORT_STATE_IMPORTING            ImportState = 3
+	IMPORT_STATE_FINISHED_WITH_ERRORS ImportState = 4
+	IMPORT_STATE_FINISHED             ImportState = 5
+)
+
+var import_state_names = map[ImportState]string{
+	IMPORT_STATE_ERROR:                "error",
+	IMPORT_STATE_CREATED:              "created",
+	IMPORT_STATE_UPLOADING:            "uploading",
+	IMPORT_STATE_UPLOADED:             "uploaded",
+	IMPORT_STATE_IMPORTING:            "importing",
+	IMPORT_STATE_FINISHED_WITH_ERRORS: "finished with errors",
+	IMPORT_STATE_FINISHED:             "finished",
+}
+
+func (s ImportState) String() string {
+	if name, ok := import_state_names[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (%d)", int(s))
+}
+
+func (s ImportState) is_known() bool {
+	_, ok := import_state_names[s]
+	return ok
+}
+
+// is_final is true if the import has ended, successfully or not. Unknown negative states are treated as errors.
+func (s ImportState) is_final() bool {
+	return s == IMPORT_STATE_FINISHED || s == IMPORT_STATE_FINISHED_WITH_ERRORS || s.failed()
+}
+
+func (s ImportState) failed() bool {
+	return s == IMPORT_STATE_ERROR || (s < 0 && !s.is_known())
+}
+
+// FlowState is the state of an uploaded file (a flow file) on the server
+type FlowState int
+
+const (
+	FLOW_STATE_CREATED    FlowState = 0
+	FLOW_STATE_UPLOADING  FlowState = 1
+	FLOW_STATE_COMPLETE   FlowState = 2
+	FLOW_STATE_ERROR      FlowState = 3
+	FLOW_STATE_JOINING    FlowState = 4
+	FLOW_STATE_JOIN_ERROR FlowState = 5
+)
+
+var flow_state_names = map[FlowState]string{
+	FLOW_STATE_CREATED:    "created",
+	FLOW_STATE_UPLOADING:  "uploading",
+	FLOW_STATE_COMPLETE:   "complete",
+	FLOW_STATE_ERROR:      "error",
+	FLOW_STATE_JOINING:    "joining",
+	FLOW_STATE_JOIN_ERROR: "join error",
+}
+
+func (s FlowState) String() string {
+	if name, ok := flow_state_names[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (%d)", int(s))
+}
+
+func (s FlowState) is_known() bool {
+	_, ok := flow_state_names[s]
+	return ok
+}
+
+// failed is true if the server could not join the chunks. Unknown negative states are treated as errors.
+func (s FlowState) failed() bool {
+	return s == FLOW_STATE_ERROR || s == FLOW_STATE_JOIN_ERROR || (s < 0 && !s.is_known())
+}
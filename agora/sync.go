@@ -0,0 +1,230 @@
+package agora
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SYNC_MANIFEST_NAME is the default name of the manifest, it is stored in the synchronized folder
+const SYNC_MANIFEST_NAME = ".agora-sync.json"
+
+const SYNC_MANIFEST_VERSION = 1
+
+type ManifestEntry struct {
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mtime"`
+	Sha1       string    `json:"sha1"`
+	DataFileId int       `json:"datafile_id,omitempty"`
+	Uploaded   time.Time `json:"uploaded"`
+}
+
+// ManifestTarget contains the files which were uploaded to one target. The keys of Files are the paths relative to
+// the synchronized folder.
+type ManifestTarget struct {
+	Url            string                   `json:"url"`
+	TargetFolderId int                      `json:"target_folder_id,omitempty"`
+	ExamId         int                      `json:"exam_id,omitempty"`
+	Files          map[string]ManifestEntry `json:"files"`
+}
+
+// Manifest keeps track of the files which were already uploaded by the sync. The same folder can be synchronized
+// to several targets.
+type Manifest struct {
+	Version int                        `json:"version"`
+	Targets map[string]*ManifestTarget `json:"targets"`
+}
+
+type SyncOptions struct {
+	Upload UploadOptions
+	// the path of the manifest. Defaults to SYNC_MANIFEST_NAME in the synchronized folder
+	Manifest string
+	// by default a file is unchanged if its size and modification time are the same as in the manifest. With
+	// Rehash the hash of every file is compared.
+	Rehash bool
+}
+
+func load_manifest(path string) (*Manifest, error) {
+	manifest := &Manifest{Version: SYNC_MANIFEST_VERSION, Targets: make(map[string]*ManifestTarget)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return manifest, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("could not read the manifest %s: %w", path, err)
+	}
+	if manifest.Version != SYNC_MANIFEST_VERSION {
+		return nil, fmt.Errorf("the manifest %s has the unsupported version %d", path, manifest.Version)
+	}
+	if manifest.Targets == nil {
+		manifest.Targets = make(map[string]*ManifestTarget)
+	}
+	return manifest, nil
+}
+
+// save writes the manifest to a temporary file first, so an interrupted sync never leaves a broken manifest behind
+func (m *Manifest) save(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp_path := path + ".tmp"
+	if err := ioutil.WriteFile(temp_path, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp_path, path)
+}
+
+func (m *Manifest) target(agora_url string, target_folder_id int, exam_id int) *ManifestTarget {
+	key := fmt.Sprintf("%s|folder=%d|exam=%d", agora_url, target_folder_id, exam_id)
+	target, ok := m.Targets[key]
+	if !ok {
+		target = &ManifestTarget{Url: agora_url, TargetFolderId: target_folder_id, ExamId: exam_id}
+		m.Targets[key] = target
+	}
+	if target.Files == nil {
+		target.Files = make(map[string]ManifestEntry)
+	}
+	return target
+}
+
+// changed_files returns the files in dir which are not in the manifest or whose content has changed. Files whose
+// content is unchanged but which were touched get their size and modification time updated in the manifest.
+func (t *ManifestTarget) changed_files(dir string, exclude string, rehash bool) ([]string, map[string]os.FileInfo, bool, error) {
+	changed := []string{}
+	infos := make(map[string]os.FileInfo)
+	updated := false
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || path == exclude || path == exclude+".tmp" {
+			return nil
+		}
+		relative_path, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		relative_path = filepath.ToSlash(relative_path)
+		infos[relative_path] = info
+
+		entry, ok := t.Files[relative_path]
+		if ok && !rehash && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+			return nil
+		}
+		if ok && entry.Size == info.Size() {
+			localSha1, err := sha1Hash(path)
+			if err != nil {
+				return err
+			}
+			if localSha1 == entry.Sha1 {
+				logrus.Debugf("%s was touched but its content is unchanged", relative_path)
+				if !entry.ModTime.Equal(info.ModTime()) {
+					entry.ModTime = info.ModTime()
+					t.Files[relative_path] = entry
+					updated = true
+				}
+				return nil
+			}
+		}
+		if ok {
+			logrus.Debugf("changed file: %s", relative_path)
+		} else {
+			logrus.Debugf("new file: %s", relative_path)
+		}
+		changed = append(changed, relative_path)
+		return nil
+	})
+	sort.Strings(changed)
+	return changed, infos, updated, err
+}
+
+// Sync uploads all files in dir which were not uploaded to the target before or which have changed since. The
+// uploaded files are recorded in a manifest, so a repeated sync only has to look at the size and modification time
+// of the files which are already in the target.
+func Sync(ctx context.Context, agora_url string, api_key string, dir string, options SyncOptions) (*Report, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a folder", dir)
+	}
+	manifest_path := options.Manifest
+	if manifest_path == "" {
+		manifest_path = filepath.Join(dir, SYNC_MANIFEST_NAME)
+	}
+	if manifest_path, err = filepath.Abs(manifest_path); err != nil {
+		return nil, err
+	}
+	manifest, err := load_manifest(manifest_path)
+	if err != nil {
+		return nil, err
+	}
+
+	target := manifest.target(agora_url, options.Upload.TargetFolderId, options.Upload.ExamId)
+	logrus.Infof("Synchronizing %s (%d files already uploaded)", dir, len(target.Files))
+	changed, infos, updated, err := target.changed_files(dir, manifest_path, options.Rehash)
+	if err != nil {
+		return nil, err
+	}
+	if updated && !options.Upload.DryRun {
+		if err := manifest.save(manifest_path); err != nil {
+			return nil, fmt.Errorf("could not save the manifest %s: %w", manifest_path, err)
+		}
+	}
+	if len(changed) == 0 {
+		logrus.Info("Everything is up to date")
+		report := new_report(agora_url, options.Upload)
+		report.finish(nil)
+		return report, nil
+	}
+	logrus.Infof("%d new or changed files", len(changed))
+
+	report, err := UploadFiles(ctx, agora_url, api_key, dir, changed, options.Upload)
+	if report == nil || options.Upload.DryRun {
+		return report, err
+	}
+
+	// if the upload failed before the import package was completed or the import failed, only the skipped files and
+	// the files which were verified to be imported are recorded, the other files are not in the target. If only the
+	// wait for the import was interrupted, the import continues on the server and all files are recorded.
+	handed_over := report.handed_over(err)
+	nof_processed := 0
+	for _, file := range report.Files {
+		if !file.is_processed(handed_over) {
+			continue
+		}
+		info, ok := infos[file.TargetPath]
+		if !ok {
+			continue
+		}
+		target.Files[file.TargetPath] = ManifestEntry{
+			Size:       info.Size(),
+			ModTime:    info.ModTime(),
+			Sha1:       file.Sha1,
+			DataFileId: file.DataFileId,
+			Uploaded:   time.Now(),
+		}
+		nof_processed++
+	}
+	if nof_processed > 0 {
+		if save_err := manifest.save(manifest_path); save_err != nil {
+			logrus.Errorf("could not save the manifest %s: %v", manifest_path, save_err)
+			if err == nil {
+				err = save_err
+			}
+		}
+	}
+	logrus.Infof("%d of %d files synchronized", nof_processed, len(changed))
+	return report, err
+}
@@ -1,10 +1,10 @@
 package agora
 
 import (
-	"archive/zip"
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha1"
-	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -17,6 +17,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -26,24 +27,48 @@ import (
 )
 
 var UPLOAD_CHUCK_SIZE int64 = 100 * 1024 * 1024
+
+// the zip bundles are created while they are uploaded, so they are never kept in memory or on disk as a whole
 var MAX_ZIP_SIZE int64 = 1024 * 1024 * 1024
 
+// MAX_ZIP_FILES limits the number of files in a zip bundle, so trees with many tiny files don't end up in a single
+// huge import
+var MAX_ZIP_FILES = 10000
+
+// MAX_UPLOAD_ATTEMPTS is the number of times a file is uploaded if its hash on the server does not match
+var MAX_UPLOAD_ATTEMPTS = 3
+
+// DEFAULT_ASSEMBLY_TIMEOUT is the time the server gets to join the chunks of a file, if no timeout is set
+const DEFAULT_ASSEMBLY_TIMEOUT = 5 * time.Minute
+
+// DEFAULT_IMPORT_POLL_INTERVAL is the interval in which the progress of an import is checked, if no interval is set
+const DEFAULT_IMPORT_POLL_INTERVAL = 5 * time.Second
+
+// UNKNOWN_STATE_TIMEOUT is the time an import may stay in a state which the uploader does not know before the upload
+// fails. A newer server might never leave such a state in a way the uploader understands.
+const UNKNOWN_STATE_TIMEOUT = 10 * time.Minute
+
+const (
+	VERIFY_MIN_POLL_INTERVAL = 200 * time.Millisecond
+	VERIFY_MAX_POLL_INTERVAL = 5 * time.Second
+)
+
 type ImportPackage struct {
-	CompleteDate     string `json:"complete_date"`
-	CreatedDate      string `json:"created_date"`
-	Error            string `json:"error"`
-	ExtractZipFiles  bool   `json:"extract_zip_files"`
-	Id               int    `json:"id"`
-	ImportFile       string `json:"import_file"`
-	ImportParameters bool   `json:"import_parameters"`
-	IsComplete       bool   `json:"is_complete"`
-	ModifiedDate     string `json:"modified_date"`
-	NofRetries       int    `json:"nof_retries"`
-	State            int    `json:"state"`
-	TargetId         int    `json:"target_id"`
-	TargetType       int    `json:"target_type"`
-	TimelineItems    []int  `json:"timeline_items"`
-	User             int    `json:"user"`
+	CompleteDate     string      `json:"complete_date"`
+	CreatedDate      string      `json:"created_date"`
+	Error            string      `json:"error"`
+	ExtractZipFiles  bool        `json:"extract_zip_files"`
+	Id               int         `json:"id"`
+	ImportFile       string      `json:"import_file"`
+	ImportParameters bool        `json:"import_parameters"`
+	IsComplete       bool        `json:"is_complete"`
+	ModifiedDate     string      `json:"modified_date"`
+	NofRetries       int         `json:"nof_retries"`
+	State            ImportState `json:"state"`
+	TargetId         int         `json:"target_id"`
+	TargetType       int         `json:"target_type"`
+	TimelineItems    []int       `json:"timeline_items"`
+	User             int         `json:"user"`
 }
 
 type UploadProgressTasks struct {
@@ -54,21 +79,79 @@ type UploadProgressTasks struct {
 }
 
 type UploadProgress struct {
-	State    int                 `json:"state"`
+	State    ImportState         `json:"state"`
 	Progress int                 `json:"progress"`
 	Tasks    UploadProgressTasks `json:"tasks"`
 }
 
+// UploadOptions holds the settings of an upload. Ids which are <= 0 are not set.
+type UploadOptions struct {
+	TargetFolderId   int
+	ExamId           int
+	SeriesId         int
+	TaskDefinitionId int
+	JsonImportFile   string
+	// ExtractZip extracts an uploaded archive (.zip, .tar, .tar.gz or .tgz) on the server
+	ExtractZip bool
+	Wait       bool
+	// the maximum time to wait for the import, 0 waits until the import has ended
+	Timeout time.Duration
+	// the interval in which the progress of the import is checked. 0 selects DEFAULT_IMPORT_POLL_INTERVAL.
+	PollInterval time.Duration
+	// the time the server gets to join the chunks of an uploaded file. 0 selects DEFAULT_ASSEMBLY_TIMEOUT.
+	AssemblyTimeout time.Duration
+	Verify          bool
+	DryRun          bool
+	SkipExisting    bool
+	// the compression of the zip bundles: COMPRESSION_STORE, or COMPRESSION_DEFLATE (default).
+	// A CompressionLevel of 0 selects the default level of the compression.
+	Compression      string
+	CompressionLevel int
+	// the format of the bundles of the small files: BUNDLE_FORMAT_ZIP (default), BUNDLE_FORMAT_TAR or BUNDLE_FORMAT_TGZ
+	BundleFormat string
+	// how the small files are grouped into bundles: BUNDLE_STRATEGY_DIRECTORY (default) or BUNDLE_STRATEGY_SEQUENTIAL
+	BundleStrategy string
+	// keep the import package on the server if the upload fails, instead of deleting it
+	KeepOnFailure bool
+	// add the files to an existing import package which is not complete yet, instead of creating a new one
+	ImportPackageId int
+	// upload the files without completing the import package, so more files can be added to it later
+	NoComplete bool
+	// store the extended attributes of the files in the bundles (Linux and macOS only)
+	PreserveXattrs bool
+	ShowProgress   bool
+	Observers      []Observer
+}
+
+const (
+	IMPORT_STATUS_IMPORTED = "imported"
+	IMPORT_STATUS_MISMATCH = "hash_mismatch"
+	IMPORT_STATUS_MISSING  = "missing"
+	IMPORT_STATUS_UNKNOWN  = "unknown"
+)
+
 type UploadFile struct {
 	SourcePath string
 	TargetPath string
-	Delete     bool
-	Imported   bool
+	Size       int64
+	ModTime    time.Time
+	Mode       os.FileMode
+	// the extended attributes, only read with UploadOptions.PreserveXattrs
+	Xattrs map[string][]byte
+	Bundle string
+	// contents is set for a bundle of small files, which is created while it is uploaded. SourcePath is not used in
+	// this case and Size is an upper bound of the size of the bundle.
+	contents     *bundleContents
+	Imported     bool
+	ImportStatus string
+	DataFileId   int
+	// the hashes are computed once while the file is read, see content_hashes
+	hashes *fileHashes
 }
 
 type FlowFile struct {
-	State       int    `json:"state"`
-	ContentHash string `json:"content_hash"`
+	State       FlowState `json:"state"`
+	ContentHash string    `json:"content_hash"`
 }
 
 type DataFile struct {
@@ -100,9 +183,9 @@ func analyse_paths(paths []string) (files_to_upload []UploadFile, files_to_zip [
 					relative_path = strings.TrimPrefix(relative_path, "/")
 
 					if info.Size() < UPLOAD_CHUCK_SIZE {
-						files_to_zip = append(files_to_zip, UploadFile{SourcePath: strings.Replace(path, "\\", "/", -1), TargetPath: relative_path, Delete: false, Imported: false})
+						files_to_zip = append(files_to_zip, UploadFile{SourcePath: strings.Replace(path, "\\", "/", -1), TargetPath: relative_path, Size: info.Size(), ModTime: info.ModTime(), Mode: info.Mode(), Imported: false})
 					} else {
-						files_to_upload = append(files_to_upload, UploadFile{SourcePath: strings.Replace(path, "\\", "/", -1), TargetPath: relative_path, Delete: false, Imported: false})
+						files_to_upload = append(files_to_upload, UploadFile{SourcePath: strings.Replace(path, "\\", "/", -1), TargetPath: relative_path, Size: info.Size(), ModTime: info.ModTime(), Mode: info.Mode(), Imported: false})
 					}
 				}
 				return nil
@@ -112,47 +195,67 @@ func analyse_paths(paths []string) (files_to_upload []UploadFile, files_to_zip [
 			if err != nil {
 				abs_path = file
 			}
-			files_to_upload = append(files_to_upload, UploadFile{SourcePath: abs_path, TargetPath: filepath.Base(file), Delete: false})
+			files_to_upload = append(files_to_upload, UploadFile{SourcePath: abs_path, TargetPath: filepath.Base(file), Size: fileInfo.Size(), ModTime: fileInfo.ModTime(), Mode: fileInfo.Mode()})
 		}
 	}
 	return files_to_upload, files_to_zip, files_only
 }
 
-func upload_chunk(client *http.Client, url string, api_key string, values map[string]io.Reader, filename string, fake bool) (err error) {
-	// Prepare a form that you will submit to that URL.
-	var b bytes.Buffer
-	w := multipart.NewWriter(&b)
-	for key, r := range values {
-		var fw io.Writer
-		if x, ok := r.(io.Closer); ok {
-			defer x.Close()
-		}
-		// Add an image file
-		_, ok := r.(*bytes.Reader)
-		if ok {
-			if fw, err = w.CreateFormFile(key, filename); err != nil {
-				return
-			}
+// collect_files prepares a list of files for the upload. The paths in the upload are relative to root.
+func collect_files(root string, paths []string) (files_to_upload []UploadFile, files_to_zip []UploadFile, files_only bool) {
+	for _, path := range paths {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(root, path)
+		}
+		fileInfo, err := os.Stat(path)
+		if err != nil || fileInfo.IsDir() {
+			logrus.Warningf("skipping %s: not a file", path)
+			continue
+		}
+		relative_path, err := filepath.Rel(root, path)
+		if err != nil {
+			relative_path = filepath.Base(path)
+		}
+		file := UploadFile{SourcePath: filepath.ToSlash(path), TargetPath: filepath.ToSlash(relative_path), Size: fileInfo.Size(), ModTime: fileInfo.ModTime(), Mode: fileInfo.Mode()}
+		if file.Size < UPLOAD_CHUCK_SIZE {
+			files_to_zip = append(files_to_zip, file)
 		} else {
-			// Add other fields
-			if fw, err = w.CreateFormField(key); err != nil {
-				return
-			}
+			files_to_upload = append(files_to_upload, file)
 		}
-		if _, err = io.Copy(fw, r); err != nil {
+	}
+	return files_to_upload, files_to_zip, false
+}
+
+func nof_chunks(size int64) int {
+	return int(math.Ceil(float64(size) / float64(UPLOAD_CHUCK_SIZE)))
+}
+
+// upload_chunk sends a chunk as multipart form. The chunk is not copied into the form, the body of the request is
+// assembled from the form fields, the chunk and the closing boundary.
+func upload_chunk(ctx context.Context, client *http.Client, url string, api_key string, fields map[string]string, filename string, chunk []byte) error {
+	var form bytes.Buffer
+	w := multipart.NewWriter(&form)
+	for key, value := range fields {
+		if err := w.WriteField(key, value); err != nil {
 			return err
 		}
-
 	}
+	if _, err := w.CreateFormFile("file", filename); err != nil {
+		return err
+	}
+	header_size := form.Len()
 	// Don't forget to close the multipart writer.
 	// If you don't close it, your request will be missing the terminating boundary.
 	w.Close()
+	header := form.Bytes()[:header_size]
+	trailer := form.Bytes()[header_size:]
 
-	// Now that you have a form, you can submit it to your handler.
-	req, err := http.NewRequest("POST", url, &b)
+	body := io.MultiReader(bytes.NewReader(header), bytes.NewReader(chunk), bytes.NewReader(trailer))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
 	if err != nil {
 		return err
 	}
+	req.ContentLength = int64(len(header) + len(chunk) + len(trailer))
 	// Don't forget to set the content type, this will contain the boundary.
 	req.Header.Set("Content-Type", w.FormDataContentType())
 	if api_key != "" {
@@ -160,16 +263,16 @@ func upload_chunk(client *http.Client, url string, api_key string, values map[st
 	}
 
 	// Submit the request
-	if !fake {
-		res, err2 := client.Do(req)
-		if err2 != nil {
-			return err2
-		}
-		// Check the response
-		if res.StatusCode != http.StatusOK {
-			err2 = fmt.Errorf("bad status: %s", res.Status)
-			return err2
-		}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	// drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	// Check the response
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status: %s", res.Status)
 	}
 
 	return nil
@@ -183,14 +286,14 @@ func generateUUID() string {
 	return u.String()
 }
 
-func sha256Hash(file string) (string, error) {
+func sha1Hash(file string) (string, error) {
 	f, err := os.Open(file)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 
-	h := sha256.New()
+	h := sha1.New()
 	if _, err := io.Copy(h, f); err != nil {
 		return "", err
 	}
@@ -199,236 +302,341 @@ func sha256Hash(file string) (string, error) {
 	return hex.EncodeToString(hash[:]), nil
 }
 
-func sha1Hash(file string) (string, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
-
-	h := sha1.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return "", err
-	}
+// hashMismatchError is returned if the content of an uploaded file on the server differs from the local file
+type hashMismatchError struct {
+	file        string
+	hash_local  string
+	hash_server string
+}
 
-	hash := h.Sum(nil)
-	return hex.EncodeToString(hash[:]), nil
+func (e *hashMismatchError) Error() string {
+	return fmt.Sprintf("hashes do not match for file %s: the server has %s, the local file %s", e.file, e.hash_server, e.hash_local)
 }
 
-func verifyHash(curFile string, uid string, api_key string, uploadUrl string) (bool, error) {
-	parsedURL, err := url.Parse(uploadUrl)
+// flowfile_url returns the url of the uploaded file with the flow identifier uid
+func flowfile_url(upload_url string, uid string) (string, error) {
+	parsedURL, err := url.Parse(upload_url)
 	if err != nil {
-		return false, errors.New("error parsing URL: " + err.Error())
+		return "", errors.New("error parsing URL: " + err.Error())
 	}
 	parsedURL.Path = fmt.Sprintf("/api/v1/flowfile/%s/", uid)
-	url := parsedURL.String()
+	return parsedURL.String(), nil
+}
 
-	hash_check_success := false
-	hashLocal, err := sha256Hash(curFile)
+func get_flowfile(url string, api_key string) (FlowFile, error) {
+	var data FlowFile
+	response, err := GetRequest(url, api_key, "", "")
 	if err != nil {
-		return false, err
+		return data, err
 	}
-	var hashServer string
+	defer response.Body.Close()
 
-	for hashServer == "" {
-		response, err := GetRequest(url, api_key, "", "")
-		if err != nil {
-			return false, err
-		}
-		defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return data, fmt.Errorf("failed to get the hash of the file from the server. http status = %d", response.StatusCode)
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return data, err
+	}
+	err = json.Unmarshal(body, &data)
+	return data, err
+}
 
-		if response.StatusCode == http.StatusOK {
-			body, err := ioutil.ReadAll(response.Body)
-			if err != nil {
-				return false, err
-			}
+// verifyHash waits until the server has joined the chunks of a file and compares the hash of the joined file with
+// the local one. The server is polled with an increasing interval for at most timeout, failed requests are retried
+// within the same time.
+func verifyHash(ctx context.Context, curFile string, hashLocal string, uid string, api_key string, uploadUrl string, timeout time.Duration) error {
+	url, err := flowfile_url(uploadUrl, uid)
+	if err != nil {
+		return err
+	}
 
-			var data FlowFile
-			err = json.Unmarshal(body, &data)
-			if err != nil {
-				return false, err
+	if timeout <= 0 {
+		timeout = DEFAULT_ASSEMBLY_TIMEOUT
+	}
+	deadline := time.Now().Add(timeout)
+	interval := VERIFY_MIN_POLL_INTERVAL
+	warned := false
+	for {
+		data, err := get_flowfile(url, api_key)
+		switch {
+		case err != nil:
+			// a network error or an error response of the server is retried until the deadline
+			if time.Now().Add(interval).After(deadline) {
+				return fmt.Errorf("could not verify the hash of %s within %v: %w", curFile, timeout, err)
 			}
-
-			if data.State == 2 {
-				hashServer = data.ContentHash
-				if hashLocal != hashServer {
-					continue
-				} else {
-					hash_check_success = true
-					break
-				}
-			} else if data.State == 3 || data.State == 5 {
-				return false, fmt.Errorf("failed to upload %v: there was an error joining the chunks", curFile)
+			logrus.Warningf("could not get the state of %s from the server, trying again: %v", curFile, err)
+		case data.State == FLOW_STATE_COMPLETE:
+			if data.ContentHash != hashLocal {
+				return &hashMismatchError{file: curFile, hash_local: hashLocal, hash_server: data.ContentHash}
 			}
-		} else {
-			return false, errors.New("failed to get the hash of the file from the server")
+			return nil
+		case data.State.failed():
+			return fmt.Errorf("failed to upload %v: there was an error joining the chunks (state: %s)", curFile, data.State)
+		default:
+			if !data.State.is_known() && !warned {
+				logrus.Warningf("the server returned the unknown state %d for %s, waiting until it changes", int(data.State), curFile)
+				warned = true
+			}
+			if time.Now().Add(interval).After(deadline) {
+				return fmt.Errorf("the server did not finish joining the chunks of %s within %v (state: %s)", curFile, timeout, data.State)
+			}
+			logrus.Debugf("waiting for the server to join the chunks of %s (state: %s)", curFile, data.State)
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		interval *= 2
+		if interval > VERIFY_MAX_POLL_INTERVAL {
+			interval = VERIFY_MAX_POLL_INTERVAL
 		}
 	}
-	return hash_check_success, nil
 }
 
-func upload_file(request_url string, api_key string, file UploadFile, fake bool) error {
-	buffer := make([]byte, UPLOAD_CHUCK_SIZE)
-	logrus.Infof("Upload file: %s > %s", file.SourcePath, request_url)
-	fileInfo, err := os.Stat(file.SourcePath)
-
-	if file.Delete {
-		logrus.Debugf("file will be removed after upload: %s", file.SourcePath)
-		defer os.Remove(file.SourcePath)
+// delete_flowfile removes an uploaded file from the import package
+func delete_flowfile(upload_url string, api_key string, uid string) error {
+	url, err := flowfile_url(upload_url, uid)
+	if err != nil {
+		return err
 	}
-
+	req, err := http.NewRequest("DELETE", url, nil)
 	if err != nil {
-		logrus.Fatalf("Could not get the file size of %s: %v", file.SourcePath, err)
 		return err
 	}
-	filesize := fileInfo.Size()
-	nof_chunks := int(math.Ceil(float64(filesize) / float64(UPLOAD_CHUCK_SIZE)))
-
-	client := &http.Client{}
-	r, err := os.Open(file.SourcePath)
+	if api_key != "" {
+		req.Header.Set("Authorization", "X-Agora-Api-Key "+api_key)
+	}
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		logrus.Fatalf("Could not open the file %s: %v", file.SourcePath, err)
 		return err
 	}
-	uuid := generateUUID()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http status = %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// upload_file uploads a file and verifies its hash on the server. A file whose content on the server differs from
+// the local file is removed from the import package and uploaded again, at most MAX_UPLOAD_ATTEMPTS times. It returns
+// the number of retries which were needed.
+func upload_file(ctx context.Context, request_url string, api_key string, file UploadFile, events *notifier, worker int, assembly_timeout time.Duration) (int, error) {
+	total_retries := 0
+	for attempt := 1; ; attempt++ {
+		uid := generateUUID()
+		retries, err := send_file(ctx, request_url, api_key, file, uid, events, worker, assembly_timeout)
+		total_retries += retries
+		var mismatch *hashMismatchError
+		if errors.As(err, &mismatch) {
+			// the corrupt file must not be imported
+			if delete_err := delete_flowfile(request_url, api_key, uid); delete_err != nil {
+				err = fmt.Errorf("%v. the file could not be removed from the import package: %v", err, delete_err)
+				logrus.Error(err)
+				events.file_verified(worker, file, err)
+				return total_retries, err
+			}
+			if attempt < MAX_UPLOAD_ATTEMPTS {
+				logrus.Warnf("%v. uploading it again (%d/%d)", err, attempt+1, MAX_UPLOAD_ATTEMPTS)
+				total_retries++
+				continue
+			}
+			logrus.Error(err)
+		}
+		events.file_verified(worker, file, err)
+		return total_retries, err
+	}
+}
+
+// send_file uploads a file in chunks with the flow identifier uid and returns the number of retries which were
+// needed. A bundle is created while it is uploaded, so its size and the number of chunks are only known once the last
+// chunk is read. Until then the chunks announce one more chunk than has been sent, so the server does not join them
+// too early.
+func send_file(ctx context.Context, request_url string, api_key string, file UploadFile, uid string, events *notifier, worker int, assembly_timeout time.Duration) (int, error) {
+	name := file.SourcePath
+	var r io.ReadCloser
+	// the size of a bundle is unknown (-1) until it is created
+	filesize := int64(-1)
+	buffer_size := UPLOAD_CHUCK_SIZE
+	if file.contents != nil {
+		name = file.TargetPath
+		logrus.Infof("Upload file: %s > %s", name, request_url)
+		r = file.contents.bundler.stream(name, file.contents, events)
+		if file.Size < buffer_size {
+			buffer_size = file.Size
+		}
+	} else {
+		logrus.Infof("Upload file: %s > %s", name, request_url)
+		fileInfo, err := os.Stat(file.SourcePath)
+		if err != nil {
+			logrus.Errorf("Could not get the file size of %s: %v", file.SourcePath, err)
+			return 0, err
+		}
+		filesize = fileInfo.Size()
+		if filesize < buffer_size {
+			buffer_size = filesize
+		}
+		f, err := os.Open(file.SourcePath)
+		if err != nil {
+			logrus.Errorf("Could not open the file %s: %v", file.SourcePath, err)
+			return 0, err
+		}
+		r = f
+	}
+	defer r.Close()
+	// the hashes are computed from the chunks which are sent, so the file is only read once
+	hashing := new_hashing_reader(r)
+	reader := bufio.NewReader(hashing)
+	if filesize < 0 {
+		// the upper bound of the size of a bundle, for the progress
+		events.file_started(worker, file, file.Size, nof_chunks(file.Size))
+	} else {
+		events.file_started(worker, file, filesize, nof_chunks(filesize))
+	}
+	nof_chunks := nof_chunks(filesize)
+
+	buffer := make([]byte, buffer_size)
+	var err error
 
 	chunk_failed := false
+	total_retries := 0
 	const maxRetries = 3
-	for i := 0; i < nof_chunks; i++ {
-		logrus.Debugf("uploading chunk %d/%d", i, nof_chunks)
-		n, err := r.Read(buffer)
+	var sent int64
+	for i := 0; filesize < 0 || i < nof_chunks; i++ {
+		var n int
+		n, err = io.ReadFull(reader, buffer)
+		if err == io.ErrUnexpectedEOF || (err == io.EOF && filesize < 0) {
+			// the last chunk is smaller than the buffer
+			err = nil
+		}
 		if err != nil {
 			chunk_failed = true
 			break
 		}
-		chunk := bytes.NewReader(buffer[0:n])
-
-		//prepare the reader instances to encode
-		values := map[string]io.Reader{
-			"file":                 chunk, // lets assume its this file
-			"description":          strings.NewReader(""),
-			"flowChunkNumber":      strings.NewReader(fmt.Sprintf("%d", i)),
-			"flowChunkSize":        strings.NewReader(fmt.Sprintf("%d", UPLOAD_CHUCK_SIZE)),
-			"flowCurrentChunkSize": strings.NewReader(fmt.Sprintf("%d", n)),
-			"flowTotalSize":        strings.NewReader(fmt.Sprintf("%d", filesize)),
-			"flowIdentifier":       strings.NewReader(uuid),
-			"flowFilename":         strings.NewReader(file.TargetPath),
-			"flowRelativePath":     strings.NewReader(file.TargetPath),
-			"flowTotalChunks":      strings.NewReader(fmt.Sprintf("%d", nof_chunks)),
+		total_size, total_chunks := filesize, nof_chunks
+		if filesize < 0 {
+			if _, err = reader.Peek(1); err == io.EOF {
+				// this is the last chunk of the bundle
+				err = nil
+				filesize = sent + int64(n)
+				nof_chunks = i + 1
+				total_size, total_chunks = filesize, nof_chunks
+			} else if err != nil {
+				chunk_failed = true
+				break
+			} else {
+				total_size, total_chunks = sent+int64(n)+1, i+2
+			}
+		}
+		logrus.Debugf("uploading chunk %d/%d", i, total_chunks)
+
+		fields := map[string]string{
+			"description":          "",
+			"flowChunkNumber":      fmt.Sprintf("%d", i),
+			"flowChunkSize":        fmt.Sprintf("%d", UPLOAD_CHUCK_SIZE),
+			"flowCurrentChunkSize": fmt.Sprintf("%d", n),
+			"flowTotalSize":        fmt.Sprintf("%d", total_size),
+			"flowIdentifier":       uid,
+			"flowFilename":         file.TargetPath,
+			"flowRelativePath":     file.TargetPath,
+			"flowTotalChunks":      fmt.Sprintf("%d", total_chunks),
 		}
 		retries := 0
 		for {
-			err = upload_chunk(client, request_url, api_key, values, filepath.Base(file.SourcePath), fake)
+			err = upload_chunk(ctx, httpClient, request_url, api_key, fields, filepath.Base(name), buffer[:n])
 			if err == nil {
 				break
 			}
+			if ctx.Err() != nil {
+				// the upload was interrupted
+				chunk_failed = true
+				break
+			}
 			retries++
+			total_retries++
 			if retries >= maxRetries {
 				chunk_failed = true
-				logrus.Errorf("failed to upload chunk %d/%d after %d retries", i, nof_chunks, retries)
+				logrus.Errorf("failed to upload chunk %d/%d after %d retries", i, total_chunks, retries)
 				break
 			}
-			logrus.Warnf("retrying upload of chunk %d/%d (%d/%d)", i, nof_chunks, retries, maxRetries)
+			logrus.Warnf("retrying upload of chunk %d/%d (%d/%d)", i, total_chunks, retries, maxRetries)
 		}
 		if chunk_failed {
 			break
 		}
+		sent += int64(n)
+		events.chunk_sent(worker, file, i+1, total_chunks, int64(n))
 	}
-	r.Close()
 	if chunk_failed {
-		logrus.Errorf("could not upload the file %s", file.SourcePath)
-		return err
+		logrus.Errorf("could not upload the file %s", name)
+		return total_retries, fmt.Errorf("could not upload the file %s: %v", name, err)
 	}
 
-	match, err := verifyHash(file.SourcePath, uuid, api_key, request_url)
-	if err != nil {
-		logrus.Errorf("could not verify the hash of the file %s: %v", file.SourcePath, err)
-		return err
+	if file.contents == nil {
+		hashing.store(file)
 	}
-	if !match {
-		err := fmt.Errorf("hashes do not match for file %s", file.SourcePath)
-		logrus.Errorf("%v", err)
-		return err
+	hashLocal, _ := hashing.sums()
+	if err := verifyHash(ctx, name, hashLocal, uid, api_key, request_url, assembly_timeout); err != nil {
+		var mismatch *hashMismatchError
+		if !errors.As(err, &mismatch) {
+			err = fmt.Errorf("could not verify the hash of the file %s: %w", name, err)
+			logrus.Error(err)
+		}
+		return total_retries, err
 	}
-	return nil
+	return total_retries, nil
 }
 
-func upload_worker(fileChan chan UploadFile, request_url string, api_key string, fake bool, wg *sync.WaitGroup) {
+func upload_worker(ctx context.Context, worker int, fileChan chan UploadFile, request_url string, api_key string, assembly_timeout time.Duration, report *Report, events *notifier, wg *sync.WaitGroup) {
 	// Decreasing internal counter for wait-group as soon as goroutine finishes
 	defer wg.Done()
 
 	for file := range fileChan {
-		upload_file(request_url, api_key, file, fake)
+		start_time := time.Now()
+		retries, err := upload_file(ctx, request_url, api_key, file, events, worker, assembly_timeout)
+		report.add_upload(file.TargetPath, retries, time.Since(start_time), err)
+		if err != nil {
+			events.error(file.SourcePath, err)
+		}
+		events.file_finished(worker, file, err)
 	}
 }
 
-func upload_files(fileCh chan UploadFile, request_url string, api_key string, files_to_upload []UploadFile, wg *sync.WaitGroup) error {
+func upload_files(ctx context.Context, fileCh chan UploadFile, request_url string, api_key string, files_to_upload []UploadFile, wg *sync.WaitGroup) error {
 	defer wg.Done()
 
 	// Processing all links by spreading them to `free` goroutines
 	for _, file := range files_to_upload {
-		fileCh <- file
+		select {
+		case fileCh <- file:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 	return nil
 }
 
-func zip_and_upload(fileCh chan UploadFile, request_url string, api_key string, files_to_zip []UploadFile, temp_dir string, wg *sync.WaitGroup) error {
+// upload_bundles queues the bundles for the upload. A bundle is created by the worker which uploads it, while it is
+// uploaded, so several bundles are compressed at the same time.
+func upload_bundles(ctx context.Context, fileCh chan UploadFile, bundles [][]UploadFile, b bundler, report *Report, wg *sync.WaitGroup) error {
 	defer wg.Done()
 
-	index := 0
-	for index < len(files_to_zip) {
-		zip_filename := fmt.Sprintf("upload_%d.agora_upload", index)
-		zip_path := filepath.Join(temp_dir, zip_filename)
-		logrus.Debugf("creating zip file: %s", zip_path)
-
-		file, err := os.Create(zip_path)
-		if err != nil {
-			logrus.Fatalf("Could not create the zip file %s: %v", zip_path, err)
-			return err
-		}
-		defer file.Close()
-
-		w := zip.NewWriter(file)
-		defer w.Close()
-
-		for _, file_to_zip := range files_to_zip[index:] {
-			logrus.Debugf("adding file to zip: %s (path in zipfile: %s)", file_to_zip.SourcePath, file_to_zip.TargetPath)
-			file, err := os.Open(file_to_zip.SourcePath)
-			if err != nil {
-				logrus.Fatalf("Could not open the file %s: %v", file_to_zip.SourcePath, err)
-				return err
-			}
-			defer file.Close()
-
-			relative_path := file_to_zip.TargetPath
-			f, err := w.Create(relative_path)
-			if err != nil {
-				logrus.Fatalf("Could not create the path %s in zip: %v", relative_path, err)
-				return err
-			}
-
-			_, err = io.Copy(f, file)
-			if err != nil {
-				logrus.Fatalf("Could not add %s to the zip file: %v", file_to_zip.SourcePath, err)
-				return err
-			}
-
-			index += 1
-
-			fileInfo, err := os.Stat(zip_path)
-			if err == nil && fileInfo.Size() > MAX_ZIP_SIZE {
-				logrus.Debugf("zip file exceeded %d MB --> uploading it", MAX_ZIP_SIZE/1024/1024)
-				break
-			}
+	for index, bundle := range bundles {
+		select {
+		case fileCh <- UploadFile{TargetPath: b.name(index), Size: b.size_bound(bundle), contents: &bundleContents{bundler: b, files: bundle, report: report}}:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		w.Close()
-		upload_file := UploadFile{SourcePath: zip_path, TargetPath: zip_filename, Delete: true}
-		fileCh <- upload_file
 	}
-
 	return nil
 }
 
+// ImportProgress returns the state and the progress of an import package
+func ImportProgress(agora_url string, api_key string, import_package_id int) (UploadProgress, error) {
+	return progress(agora_url, api_key, import_package_id)
+}
+
 func progress(agora_url string, api_key string, import_package_id int) (UploadProgress, error) {
 	var cur_progress UploadProgress
 
@@ -440,6 +648,7 @@ func progress(agora_url string, api_key string, import_package_id int) (UploadPr
 	if err != nil {
 		return cur_progress, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		err_status := fmt.Errorf("could not get the upload progress. http status = %d", resp.StatusCode)
 		return cur_progress, err_status
@@ -487,11 +696,11 @@ func complete(agora_url string, api_key string, import_package_id int, target_fo
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 204 {
 		err_status := fmt.Errorf("the \"complete\" request was invalid. http status = %d. make sure the target folder does exist", resp.StatusCode)
 		return err_status
@@ -499,6 +708,30 @@ func complete(agora_url string, api_key string, import_package_id int, target_fo
 	return nil
 }
 
+// get_existing_import_package returns an import package which was created before. It must not be complete yet, so
+// more files can be added to it.
+func get_existing_import_package(agora_url string, api_key string, import_package_id int) (ImportPackage, error) {
+	var res ImportPackage
+	request_url := join_url(agora_url, "/api/v1/import/")
+	request_url = join_url(request_url, fmt.Sprintf("/%d/", import_package_id)) + "/"
+
+	resp, err := GetRequest(request_url, api_key, "", "")
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return res, fmt.Errorf("could not get the import package %d. http status = %d", import_package_id, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return res, err
+	}
+	if res.IsComplete {
+		return res, fmt.Errorf("the import package %d is already complete, no more files can be added to it", import_package_id)
+	}
+	return res, nil
+}
+
 func get_import_package(agora_url string, api_key string) (ImportPackage, error) {
 	var res ImportPackage
 	request_url := join_url(agora_url, "/api/v1/import/") + "/"
@@ -513,12 +746,12 @@ func get_import_package(agora_url string, api_key string) (ImportPackage, error)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := httpClient.Do(req)
 
 	if err != nil {
 		return res, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 201 {
 		err_status := fmt.Errorf("could not get the import session. http status = %d", resp.StatusCode)
 		return res, err_status
@@ -528,7 +761,7 @@ func get_import_package(agora_url string, api_key string) (ImportPackage, error)
 	return res, nil
 }
 
-func update_import_state(files []UploadFile, agora_url string, importPackageId int, api_key string) (bool, error) {
+func update_import_state(files []UploadFile, agora_url string, importPackageId int, api_key string, extract_archives bool) (bool, error) {
 	logrus.Info("\nChecking Imports:")
 	logrus.Info("-----------------")
 	request_url := join_url(agora_url, "/api/v1/import/")
@@ -557,9 +790,6 @@ func update_import_state(files []UploadFile, agora_url string, importPackageId i
 	}
 
 	datafiles := []DataFile{}
-	if len(data) > 0 && len(data[0].DataFiles) == 0 {
-		return true, nil
-	}
 	for _, entry := range data {
 		datafiles = append(datafiles, entry.DataFiles...)
 	}
@@ -571,75 +801,249 @@ func update_import_state(files []UploadFile, agora_url string, importPackageId i
 	for _, datafile := range uniqueDataFiles {
 		datafiles = append(datafiles, datafile)
 	}
-	for _, datafile := range datafiles {
-		for _, file := range files {
-			if filepath.Base(file.TargetPath) == filepath.Base(datafile.Name) && !file.Imported {
-				localSha1, err := sha1Hash(file.SourcePath)
-				status := "FAILED:  "
-				//statusColor := color.New(color.FgRed).SprintFunc()
-				if err != nil {
-					status = "UNKNOWN:"
-					//statusColor = color.New(color.FgYellow).SprintFunc()
-				}
-				if localSha1 == datafile.Sha1 {
-					file.Imported = true
-					status = "IMPORTED:"
-					//statusColor = color.New(color.FgGreen).SprintFunc()
-				}
-				logrus.Infof("%s %s\t", status, file.SourcePath)
+	sort.Slice(datafiles, func(i, j int) bool { return datafiles[i].ID < datafiles[j].ID })
+
+	return match_datafiles(files, datafiles, extract_archives), nil
+}
+
+func normalize_path(path string) string {
+	return strings.TrimPrefix(strings.Replace(path, "\\", "/", -1), "/")
+}
+
+// paths_match compares the relative path of an uploaded file with the name of a datafile. The name can either be
+// the full relative path or only a part of it (e.g. the filename), in which case the longer path has to end with
+// the shorter one.
+func paths_match(target_path string, datafile_name string) bool {
+	target_path = normalize_path(target_path)
+	datafile_name = normalize_path(datafile_name)
+	return target_path == datafile_name || strings.HasSuffix(target_path, "/"+datafile_name) || strings.HasSuffix(datafile_name, "/"+target_path)
+}
+
+// match_datafiles assigns the datafiles of an import to the uploaded files by their relative path and sha1. The
+// import status of the files is updated in place and the datafiles which do not belong to any file are reported.
+// It returns true if all files were imported with the correct content.
+// With extract_archives the archives are extracted on the server, so their content can't be matched file by file.
+// An archive counts as imported if the import contains datafiles which do not belong to any other file.
+func match_datafiles(files []UploadFile, datafiles []DataFile, extract_archives bool) bool {
+	used := make(map[int]bool)
+	hashes := make([]string, len(files))
+	extracted := make([]bool, len(files))
+	for i := range files {
+		files[i].Imported = false
+		files[i].ImportStatus = IMPORT_STATUS_MISSING
+		files[i].DataFileId = 0
+		if extract_archives && is_archive(files[i].TargetPath) {
+			extracted[i] = true
+			continue
+		}
+		_, localSha1, err := files[i].content_hashes()
+		if err != nil {
+			logrus.Warningf("could not calculate the hash of %s: %v", files[i].SourcePath, err)
+			files[i].ImportStatus = IMPORT_STATUS_UNKNOWN
+			continue
+		}
+		hashes[i] = localSha1
+	}
+
+	// first pass: the path and the content match
+	for i := range files {
+		if hashes[i] == "" {
+			continue
+		}
+		for _, datafile := range datafiles {
+			if !used[datafile.ID] && datafile.Sha1 == hashes[i] && paths_match(files[i].TargetPath, datafile.Name) {
+				used[datafile.ID] = true
+				files[i].Imported = true
+				files[i].ImportStatus = IMPORT_STATUS_IMPORTED
+				files[i].DataFileId = datafile.ID
 				break
 			}
 		}
 	}
-	return true, nil
+
+	// second pass: the path matches but the content is different
+	for i := range files {
+		if files[i].ImportStatus != IMPORT_STATUS_MISSING || extracted[i] {
+			continue
+		}
+		for _, datafile := range datafiles {
+			if !used[datafile.ID] && paths_match(files[i].TargetPath, datafile.Name) {
+				used[datafile.ID] = true
+				files[i].ImportStatus = IMPORT_STATUS_MISMATCH
+				files[i].DataFileId = datafile.ID
+				break
+			}
+		}
+	}
+
+	// the remaining datafiles are the content of the extracted archives
+	nof_unused := 0
+	for _, datafile := range datafiles {
+		if !used[datafile.ID] {
+			nof_unused++
+		}
+	}
+	nof_archives := 0
+	for i := range files {
+		if !extracted[i] {
+			continue
+		}
+		nof_archives++
+		if nof_unused > 0 {
+			files[i].Imported = true
+			files[i].ImportStatus = IMPORT_STATUS_IMPORTED
+		}
+	}
+
+	nof_imported := 0
+	for i, file := range files {
+		if extracted[i] {
+			if file.Imported {
+				nof_imported++
+				logrus.Infof("EXTRACTED: %s\t", file.SourcePath)
+			} else {
+				logrus.Errorf("MISSING:  %s (the import contains no extracted files)\t", file.SourcePath)
+			}
+			continue
+		}
+		switch file.ImportStatus {
+		case IMPORT_STATUS_IMPORTED:
+			nof_imported++
+			logrus.Infof("IMPORTED: %s\t", file.SourcePath)
+		case IMPORT_STATUS_MISMATCH:
+			logrus.Errorf("MISMATCH: %s (datafile %d has a different sha1)\t", file.SourcePath, file.DataFileId)
+		case IMPORT_STATUS_MISSING:
+			logrus.Errorf("MISSING:  %s\t", file.SourcePath)
+		default:
+			logrus.Warningf("UNKNOWN:  %s\t", file.SourcePath)
+		}
+	}
+	nof_extra := 0
+	for _, datafile := range datafiles {
+		if !used[datafile.ID] && nof_archives == 0 {
+			nof_extra++
+			logrus.Warningf("EXTRA:    %s (datafile %d does not belong to any uploaded file)\t", datafile.Name, datafile.ID)
+		}
+	}
+	if nof_archives > 0 {
+		logrus.Infof("\n%d of %d files imported, %d datafiles extracted from %d archives", nof_imported, len(files), nof_unused, nof_archives)
+	} else {
+		logrus.Infof("\n%d of %d files imported, %d datafiles without matching file", nof_imported, len(files), nof_extra)
+	}
+	return nof_imported == len(files)
 }
 
-func upload(agora_url string, api_key string, input_files []string, target_folder_id int, exam_id int, series_id int, task_definition_id int, json_import_file string, wait bool, timeout int, extract_zip bool, verify bool, fake bool) (UploadProgress, error) {
-	wait = wait || verify
+type scanFunc func() (files_to_upload []UploadFile, files_to_zip []UploadFile, files_only bool)
+
+func upload(ctx context.Context, agora_url string, api_key string, input_files []string, scan scanFunc, options UploadOptions, report *Report, events *notifier) (UploadProgress, error) {
+	wait := options.Wait || options.Verify
+	events.scan_started(input_files)
 
 	logrus.Info("Preparing Data:")
 	logrus.Info("-----------------")
-	files_to_upload, files_to_zip, files_only := analyse_paths(input_files)
+	files_to_upload, files_to_zip, files_only := scan()
+	init_hashes(files_to_upload)
+	init_hashes(files_to_zip)
 	if !files_only {
 		logrus.Infof("Found %d files larger than %dMB which will be uploaded directly", len(files_to_upload), UPLOAD_CHUCK_SIZE/1024/1024)
 		logrus.Infof("Found %d files which will be zipped and uploaded", len(files_to_zip))
 	}
-	allFiles := append(files_to_upload, files_to_zip...)
-	logrus.Info("\nUploading Data:")
-	logrus.Info("-----------------")
 
-	import_package, err := get_import_package(agora_url, api_key)
+	if options.SkipExisting {
+		if options.DryRun {
+			logrus.Warning("\"--skip-existing\" requires the server and is not evaluated in a dry run")
+		} else {
+			datafiles, err := get_existing_datafiles(agora_url, api_key, options.TargetFolderId, options.ExamId)
+			if err != nil {
+				return UploadProgress{}, err
+			}
+			files_to_upload, files_to_zip, report.skipped = skip_existing(files_to_upload, files_to_zip, datafiles)
+			if len(files_to_upload) == 0 && len(files_to_zip) == 0 {
+				logrus.Info("\nAll files are already present in the target. Nothing to upload")
+				return UploadProgress{}, nil
+			}
+		}
+	}
+
+	compression, err := parse_compression(options.Compression, options.CompressionLevel)
 	if err != nil {
 		return UploadProgress{}, err
 	}
+	bundler, err := new_bundler(options.BundleFormat, options.BundleStrategy, compression)
+	if err != nil {
+		return UploadProgress{}, err
+	}
+	if options.PreserveXattrs {
+		collect_xattrs(files_to_upload)
+		collect_xattrs(files_to_zip)
+	}
+
+	bundles := plan_bundles(files_to_zip, bundler)
+	allFiles := append([]UploadFile{}, files_to_upload...)
+	for _, bundle := range bundles {
+		allFiles = append(allFiles, bundle...)
+	}
+	report.files = allFiles
+	for _, file := range allFiles {
+		events.file_queued(file)
+	}
+
+	if options.DryRun {
+		print_dry_run(agora_url, files_to_upload, bundles, bundler, options.TargetFolderId, options.ExamId, options.SeriesId, options.JsonImportFile, options.ExtractZip)
+		return UploadProgress{}, nil
+	}
+
+	logrus.Info("\nUploading Data:")
+	logrus.Info("-----------------")
+
+	if ctx.Err() != nil {
+		return UploadProgress{}, fmt.Errorf("the upload was interrupted: %w", ctx.Err())
+	}
+	var import_package ImportPackage
+	if options.ImportPackageId > 0 {
+		import_package, err = get_existing_import_package(agora_url, api_key, options.ImportPackageId)
+		if err != nil {
+			return UploadProgress{}, err
+		}
+		logrus.Infof("Adding the files to the import package %d", import_package.Id)
+	} else {
+		import_package, err = get_import_package(agora_url, api_key)
+		if err != nil {
+			return UploadProgress{}, err
+		}
+		logrus.Debugf("created the import package %d", import_package.Id)
+	}
+	report.ImportPackageId = import_package.Id
+	// a reused import package also contains the files of earlier uploads, so it is never deleted
+	keep_on_failure := options.KeepOnFailure || options.ImportPackageId > 0
 
 	request_url := join_url(agora_url, "/api/v1/import/")
 	request_url = join_url(request_url, fmt.Sprintf("/%d/", import_package.Id))
 	request_url = join_url(request_url, "/upload/") + "/"
 
-	// we have 2 threadpools here. One performs the large file upload and the zipping in parallel. One performs a parallel file upload
-	parallel_uploads := 3
+	// the import package is deleted if any file fails, so the remaining files are not uploaded anymore after the first
+	// failure
+	upload_ctx, cancel_upload := context.WithCancel(ctx)
+	defer cancel_upload()
+	if !keep_on_failure {
+		report.on_failure = cancel_upload
+	}
 
+	// we have 2 threadpools here. One performs the large file upload and the zipping in parallel. One performs a parallel file upload
 	fileCh := make(chan UploadFile)
 	wg := new(sync.WaitGroup)
 
 	// Adding routines to workgroup and running then
-	for i := 0; i < parallel_uploads; i++ {
+	for i := 0; i < PARALLEL_UPLOADS; i++ {
 		wg.Add(1)
-		go upload_worker(fileCh, request_url, api_key, fake, wg)
-	}
-
-	temp_dir, err := ioutil.TempDir("", "agora_app")
-	defer os.RemoveAll(temp_dir)
-	if err != nil {
-		return UploadProgress{}, err
+		go upload_worker(upload_ctx, i, fileCh, request_url, api_key, options.AssemblyTimeout, report, events, wg)
 	}
 
 	wg_upload_zip := new(sync.WaitGroup)
 	wg_upload_zip.Add(2)
 
-	go upload_files(fileCh, request_url, api_key, files_to_upload, wg_upload_zip)
-	go zip_and_upload(fileCh, request_url, api_key, files_to_zip, temp_dir, wg_upload_zip)
+	go upload_files(upload_ctx, fileCh, request_url, api_key, files_to_upload, wg_upload_zip)
+	go upload_bundles(upload_ctx, fileCh, bundles, bundler, report, wg_upload_zip)
 	wg_upload_zip.Wait()
 
 	// Closing channel (waiting in goroutines won't continue any more)
@@ -648,66 +1052,184 @@ func upload(agora_url string, api_key string, input_files []string, target_folde
 	// Waiting for all goroutines to finish (otherwise they die as main routine dies)
 	wg.Wait()
 
-	if err = complete(agora_url, api_key, import_package.Id, target_folder_id, exam_id, series_id, task_definition_id, json_import_file, extract_zip); err == nil {
-		if wait {
-			if verify {
-				logrus.Info("\nWaiting for the Imports to finish...")
-			} else {
-				logrus.Info("\nWaiting for the Uploads to finish...")
+	// an interrupted upload is aborted before the import package is complete
+	if ctx.Err() != nil {
+		logrus.Error("the upload was interrupted")
+		abort_import(agora_url, api_key, import_package.Id, keep_on_failure)
+		return UploadProgress{}, fmt.Errorf("the upload was interrupted: %w", ctx.Err())
+	}
+	// an import package with missing files is never completed
+	if failed := report.nof_failed(); failed > 0 {
+		abort_import(agora_url, api_key, import_package.Id, keep_on_failure)
+		return UploadProgress{}, fmt.Errorf("%d files or bundles could not be uploaded", failed)
+	}
+	if options.NoComplete {
+		logrus.Infof("\nThe files were uploaded to the import package %d, which is not complete yet. Use \"--import-package %d\" to add more files to it.", import_package.Id, import_package.Id)
+		return UploadProgress{}, nil
+	}
+	err = complete(agora_url, api_key, import_package.Id, options.TargetFolderId, options.ExamId, options.SeriesId, options.TaskDefinitionId, options.JsonImportFile, options.ExtractZip)
+	if err != nil {
+		abort_import(agora_url, api_key, import_package.Id, keep_on_failure)
+		return UploadProgress{}, err
+	}
+	report.Completed = true
+	if wait {
+		return wait_for_import(ctx, agora_url, api_key, import_package.Id, allFiles, options, report, events)
+	}
+	logrus.Infof("\nThe upload is complete, the import continues on the server. Import ID: %d", import_package.Id)
+	return UploadProgress{}, nil
+}
+
+// wait_for_import waits until the import of a complete import package has ended and verifies the imported files if
+// options.Verify is set
+func wait_for_import(ctx context.Context, agora_url string, api_key string, import_package_id int, files []UploadFile, options UploadOptions, report *Report, events *notifier) (UploadProgress, error) {
+	poll_interval := options.PollInterval
+	if poll_interval <= 0 {
+		poll_interval = DEFAULT_IMPORT_POLL_INTERVAL
+	}
+	if options.Verify {
+		logrus.Info("\nWaiting for the Imports to finish...")
+	} else {
+		logrus.Info("\nWaiting for the Uploads to finish...")
+	}
+	start_time := time.Now()
+	var unknown_since time.Time
+	for options.Timeout <= 0 || time.Since(start_time) < options.Timeout {
+		data, err := progress(agora_url, api_key, import_package_id)
+		if err != nil {
+			return UploadProgress{}, err
+		}
+		events.import_progress(import_package_id, data)
+		report.ImportState = data.State.String()
+		// unknown negative states are errors, which are handled below
+		if data.State.is_known() || data.State.failed() {
+			unknown_since = time.Time{}
+		} else if unknown_since.IsZero() {
+			logrus.Warningf("the import %d has the unknown state %d, waiting at most %v until it changes", import_package_id, int(data.State), UNKNOWN_STATE_TIMEOUT)
+			unknown_since = time.Now()
+		} else if time.Since(unknown_since) > UNKNOWN_STATE_TIMEOUT {
+			return data, fmt.Errorf("the import %d has had the unknown state %d for more than %v", import_package_id, int(data.State), UNKNOWN_STATE_TIMEOUT)
+		}
+		logrus.Debugf("import %d: %s (%d%%)", import_package_id, data.State, data.Progress)
+		if data.State.failed() {
+			return data, fmt.Errorf("the import failed (state: %s)", data.State)
+		}
+		if data.State.is_final() {
+			if !options.Verify {
+				return data, nil
 			}
-			start_time := time.Now()
-			for timeout < 0 || time.Since(start_time).Seconds() < float64(timeout) {
-				data, err := progress(agora_url, api_key, import_package.Id)
+			// an import which finished with errors is verified as well, so the missing files are reported
+			if data.State == IMPORT_STATE_FINISHED_WITH_ERRORS || data.Progress == 100 {
+				success, err := update_import_state(files, agora_url, import_package_id, api_key, options.ExtractZip)
 				if err != nil {
 					return UploadProgress{}, err
 				}
-				if data.State == 5 || data.State == 4 {
-					if verify {
-
-						if data.State == 5 && data.Progress == 100 {
-							success, err := update_import_state(allFiles, agora_url, import_package.Id, api_key)
-							if err != nil {
-								return UploadProgress{}, err
-							}
-							if success {
-								logrus.Info("\nAll files were imported successfully!\n")
-								return data, nil
-							} else {
-								logrus.Error("\nNot all files were imported successfully!\n")
-								return data, nil
-							}
-						}
-					} else {
-						return data, nil
-					}
-
-				} else if data.State == -1 {
-					return data, errors.New("the import failed")
+				if success {
+					logrus.Info("\nAll files were imported successfully!\n")
+					return data, nil
+				} else {
+					logrus.Error("\nNot all files were imported successfully!\n")
+					return data, errors.New("the verification of the imported files failed")
 				}
-				time.Sleep(5 * time.Second)
 			}
-			err = errors.New("upload progress timeout")
-			return UploadProgress{}, err
 		}
-	} else {
-		return UploadProgress{}, err
+		// the import package is complete, so the import continues on the server if the wait is interrupted
+		select {
+		case <-time.After(poll_interval):
+		case <-ctx.Done():
+			return data, fmt.Errorf("the upload was interrupted while waiting for the import %d: %w", import_package_id, ctx.Err())
+		}
 	}
-	return UploadProgress{}, nil
+	return UploadProgress{}, fmt.Errorf("the import %d did not finish within %v", import_package_id, options.Timeout)
+}
+
+// Upload uploads a file or folder and returns a report of the upload. The report is also returned (and
+// complete as far as the upload got) if an error occurs.
+func Upload(agora_url string, api_key string, file_or_dir string, options UploadOptions) (*Report, error) {
+	return UploadContext(context.Background(), agora_url, api_key, file_or_dir, options)
 }
 
-func Upload(agora_url string, api_key string, file_or_dir string, target_folder_id int, extract_zip bool, json_import_file string, wait bool, timeout int, verify bool, fake bool) (UploadProgress, error) {
-	if extract_zip {
+// UploadContext is Upload with a context. If the context is cancelled (e.g. on Ctrl-C) before the import package is
+// complete, the upload stops and the import package is deleted (unless KeepOnFailure is set).
+func UploadContext(ctx context.Context, agora_url string, api_key string, file_or_dir string, options UploadOptions) (*Report, error) {
+	if options.ExtractZip {
 		fileInfo, err := os.Stat(file_or_dir)
 		if err == nil {
 			if fileInfo.IsDir() {
-				logrus.Warningf("\"--extract-zip\" has no effect when uploading a directory and will be ignored")
-			} else if filepath.Ext(file_or_dir) != ".zip" {
-				logrus.Warningf("no zip file found. \"--extract-zip\" will be ignored")
+				logrus.Warningf("\"--extract-archive\" has no effect when uploading a directory and will be ignored")
+			} else if !is_archive(file_or_dir) {
+				logrus.Warningf("no archive (.zip, .tar, .tar.gz or .tgz) found. \"--extract-archive\" will be ignored")
 			}
 		}
 	}
 
 	input_files := []string{file_or_dir}
 	logrus.Debugf("Starting upload of %s to %s", file_or_dir, agora_url)
-	return upload(agora_url, api_key, input_files, target_folder_id, -1, -1, -1, json_import_file, wait, timeout, extract_zip, verify, fake)
+	scan := func() ([]UploadFile, []UploadFile, bool) {
+		return analyse_paths(input_files)
+	}
+	return run_upload(ctx, agora_url, api_key, input_files, scan, options)
+}
+
+// UploadFiles uploads a list of files. The files keep their path relative to root in the upload. Paths which are
+// not absolute are relative to root.
+func UploadFiles(ctx context.Context, agora_url string, api_key string, root string, files []string, options UploadOptions) (*Report, error) {
+	logrus.Debugf("Starting upload of %d files in %s to %s", len(files), root, agora_url)
+	scan := func() ([]UploadFile, []UploadFile, bool) {
+		return collect_files(root, files)
+	}
+	return run_upload(ctx, agora_url, api_key, []string{root}, scan, options)
+}
+
+// check_import waits for the import of a package which an earlier upload of the same files has completed, and
+// verifies it with options.Verify, without uploading the files again. The files are scanned again for the
+// verification, which is skipped for an upload with SkipExisting since the skipped files are not known anymore.
+func check_import(ctx context.Context, agora_url string, api_key string, import_package_id int, scan scanFunc, options UploadOptions) (*Report, error) {
+	report := new_report(agora_url, options)
+	report.ImportPackageId = import_package_id
+	report.Completed = true
+	events := new_notifier(options.Observers...)
+	var files []UploadFile
+	if options.Verify {
+		if options.SkipExisting {
+			logrus.Warningf("the files of the import %d are not verified, the files which were skipped are not known anymore", import_package_id)
+			options.Verify = false
+		} else {
+			files_to_upload, files_to_zip, _ := scan()
+			files = append(files_to_upload, files_to_zip...)
+			init_hashes(files)
+		}
+	}
+	progress, err := wait_for_import(ctx, agora_url, api_key, import_package_id, files, options, report, events)
+	report.Progress = progress
+	report.finish(err)
+	if err != nil {
+		events.error("", err)
+	}
+	events.completed(report)
+	return report, err
+}
+
+func run_upload(ctx context.Context, agora_url string, api_key string, input_files []string, scan scanFunc, options UploadOptions) (*Report, error) {
+	report := new_report(agora_url, options)
+	size_connection_pool(1)
+	observers := options.Observers
+	var display *progressDisplay
+	if options.ShowProgress && !options.DryRun {
+		display = new_progress_display(PARALLEL_UPLOADS)
+		observers = append([]Observer{display}, observers...)
+		display.start()
+	}
+	events := new_notifier(observers...)
+	progress, err := upload(ctx, agora_url, api_key, input_files, scan, options, report, events)
+	if display != nil {
+		display.stop()
+	}
+	report.Progress = progress
+	report.finish(err)
+	if err != nil {
+		events.error("", err)
+	}
+	events.completed(report)
+	return report, err
 }
@@ -0,0 +1,353 @@
+package agora
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPathsMatch(t *testing.T) {
+	tests := []struct {
+		target_path   string
+		datafile_name string
+		want          bool
+	}{
+		{"series_1/image.dcm", "series_1/image.dcm", true},
+		{"series_1/image.dcm", "image.dcm", true},
+		{"image.dcm", "exam/series_1/image.dcm", true},
+		{"/series_1/image.dcm", "series_1/image.dcm", true},
+		{"series_1\\image.dcm", "series_1/image.dcm", true},
+		{"series_1/image.dcm", "series_2/image.dcm", false},
+		{"series_1/image.dcm", "other_image.dcm", false},
+		{"series_1/my_image.dcm", "image.dcm", false},
+		{"image.dcm", "series_1/my_image.dcm", false},
+	}
+	for _, tt := range tests {
+		if got := paths_match(tt.target_path, tt.datafile_name); got != tt.want {
+			t.Errorf("paths_match(%q, %q) = %v, want %v", tt.target_path, tt.datafile_name, got, tt.want)
+		}
+	}
+}
+
+func sha1_hex(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestMatchDatafiles(t *testing.T) {
+	dir := t.TempDir()
+	first := []byte("first")
+	second := []byte("second")
+	a := create_test_file(t, dir, "series_1/a.dcm", first)
+	b := create_test_file(t, dir, "series_1/b.dcm", second)
+	same := create_test_file(t, dir, "series_2/a.dcm", first)
+	archive := create_test_file(t, dir, "exam.zip", []byte("not a real zip"))
+	missing_file := UploadFile{SourcePath: dir + "/does_not_exist", TargetPath: "does_not_exist"}
+
+	tests := []struct {
+		name             string
+		files            []UploadFile
+		datafiles        []DataFile
+		extract_archives bool
+		want             bool
+		want_status      []string
+		want_ids         []int
+	}{
+		{
+			name:        "all imported",
+			files:       []UploadFile{a, b},
+			datafiles:   []DataFile{{ID: 1, Name: "b.dcm", Sha1: sha1_hex(second)}, {ID: 2, Name: "series_1/a.dcm", Sha1: sha1_hex(first)}},
+			want:        true,
+			want_status: []string{IMPORT_STATUS_IMPORTED, IMPORT_STATUS_IMPORTED},
+			want_ids:    []int{2, 1},
+		},
+		{
+			name:        "missing datafile",
+			files:       []UploadFile{a, b},
+			datafiles:   []DataFile{{ID: 1, Name: "a.dcm", Sha1: sha1_hex(first)}},
+			want:        false,
+			want_status: []string{IMPORT_STATUS_IMPORTED, IMPORT_STATUS_MISSING},
+			want_ids:    []int{1, 0},
+		},
+		{
+			name:        "different content",
+			files:       []UploadFile{a, b},
+			datafiles:   []DataFile{{ID: 1, Name: "a.dcm", Sha1: sha1_hex(first)}, {ID: 2, Name: "b.dcm", Sha1: sha1_hex(first)}},
+			want:        false,
+			want_status: []string{IMPORT_STATUS_IMPORTED, IMPORT_STATUS_MISMATCH},
+			want_ids:    []int{1, 2},
+		},
+		{
+			name:        "a datafile is only assigned to one file",
+			files:       []UploadFile{a, same},
+			datafiles:   []DataFile{{ID: 1, Name: "a.dcm", Sha1: sha1_hex(first)}},
+			want:        false,
+			want_status: []string{IMPORT_STATUS_IMPORTED, IMPORT_STATUS_MISSING},
+			want_ids:    []int{1, 0},
+		},
+		{
+			name:  "files with the same name and content",
+			files: []UploadFile{a, same},
+			datafiles: []DataFile{
+				{ID: 1, Name: "series_2/a.dcm", Sha1: sha1_hex(first)},
+				{ID: 2, Name: "series_1/a.dcm", Sha1: sha1_hex(first)},
+			},
+			want:        true,
+			want_status: []string{IMPORT_STATUS_IMPORTED, IMPORT_STATUS_IMPORTED},
+		},
+		{
+			name:        "the file can't be read",
+			files:       []UploadFile{missing_file},
+			datafiles:   []DataFile{{ID: 1, Name: "does_not_exist", Sha1: sha1_hex(first)}},
+			want:        false,
+			want_status: []string{IMPORT_STATUS_UNKNOWN},
+		},
+		{
+			name:             "extracted archive",
+			files:            []UploadFile{archive, a},
+			datafiles:        []DataFile{{ID: 1, Name: "a.dcm", Sha1: sha1_hex(first)}, {ID: 2, Name: "exam/image.dcm", Sha1: sha1_hex(second)}},
+			extract_archives: true,
+			want:             true,
+			want_status:      []string{IMPORT_STATUS_IMPORTED, IMPORT_STATUS_IMPORTED},
+		},
+		{
+			name:             "archive without extracted files",
+			files:            []UploadFile{archive, a},
+			datafiles:        []DataFile{{ID: 1, Name: "a.dcm", Sha1: sha1_hex(first)}},
+			extract_archives: true,
+			want:             false,
+			want_status:      []string{IMPORT_STATUS_MISSING, IMPORT_STATUS_IMPORTED},
+		},
+		{
+			name:        "archive which is not extracted",
+			files:       []UploadFile{archive},
+			datafiles:   []DataFile{{ID: 1, Name: "exam.zip", Sha1: sha1_hex([]byte("not a real zip"))}},
+			want:        true,
+			want_status: []string{IMPORT_STATUS_IMPORTED},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := append([]UploadFile{}, tt.files...)
+			init_hashes(files)
+			if got := match_datafiles(files, tt.datafiles, tt.extract_archives); got != tt.want {
+				t.Errorf("match_datafiles() = %v, want %v", got, tt.want)
+			}
+			for i, file := range files {
+				if file.ImportStatus != tt.want_status[i] {
+					t.Errorf("%s: import status %q, want %q", file.TargetPath, file.ImportStatus, tt.want_status[i])
+				}
+				if tt.want_ids != nil && file.DataFileId != tt.want_ids[i] {
+					t.Errorf("%s: datafile %d, want %d", file.TargetPath, file.DataFileId, tt.want_ids[i])
+				}
+			}
+		})
+	}
+}
+
+// fakeAgora is an Agora server which joins the uploaded chunks, extracts the zip bundles and imports their content
+type fakeAgora struct {
+	mutex     sync.Mutex
+	flows     map[string]*fakeFlow
+	datafiles []DataFile
+	// the number of chunks of every uploaded file or bundle
+	chunks    map[string]int
+	completed bool
+}
+
+type fakeFlow struct {
+	name   string
+	total  int
+	chunks map[int][]byte
+	// the joined chunks, once all chunks were uploaded
+	joined bool
+	data   []byte
+}
+
+func new_fake_agora() *fakeAgora {
+	return &fakeAgora{flows: make(map[string]*fakeFlow), chunks: make(map[string]int)}
+}
+
+func (f *fakeAgora) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if r.Header.Get("Authorization") != "X-Agora-Api-Key test-key" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 3 || parts[0] != "api" || parts[1] != "v1" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch {
+	case len(parts) == 3 && parts[2] == "import" && r.Method == http.MethodPost:
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id": 1}`)
+	case len(parts) == 5 && parts[2] == "import" && parts[4] == "upload":
+		f.upload_chunk(w, r)
+	case len(parts) == 4 && parts[2] == "flowfile" && r.Method == http.MethodGet:
+		flow, ok := f.flows[parts[3]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !flow.joined {
+			fmt.Fprintf(w, `{"state": %d}`, FLOW_STATE_UPLOADING)
+			return
+		}
+		sum := sha256.Sum256(flow.data)
+		fmt.Fprintf(w, `{"state": %d, "content_hash": "%s"}`, FLOW_STATE_COMPLETE, hex.EncodeToString(sum[:]))
+	case len(parts) == 5 && parts[2] == "import" && parts[4] == "complete":
+		f.completed = true
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 5 && parts[2] == "import" && parts[4] == "progress":
+		fmt.Fprintf(w, `{"state": %d, "progress": 100, "tasks": {"count": 1, "finished": 1}}`, IMPORT_STATE_FINISHED)
+	case len(parts) == 5 && parts[2] == "import" && parts[4] == "result":
+		json.NewEncoder(w).Encode([]ImportResult{{DataFiles: f.datafiles}})
+	case len(parts) == 4 && parts[2] == "import" && r.Method == http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeAgora) upload_chunk(w http.ResponseWriter, r *http.Request) {
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	number, _ := strconv.Atoi(r.FormValue("flowChunkNumber"))
+	total, _ := strconv.Atoi(r.FormValue("flowTotalChunks"))
+	uid := r.FormValue("flowIdentifier")
+	flow, ok := f.flows[uid]
+	if !ok {
+		flow = &fakeFlow{name: r.FormValue("flowRelativePath"), chunks: make(map[int][]byte)}
+		f.flows[uid] = flow
+	}
+	flow.chunks[number] = data
+	flow.total = total
+	if len(flow.chunks) < flow.total {
+		return
+	}
+	var joined bytes.Buffer
+	for i := 0; i < flow.total; i++ {
+		joined.Write(flow.chunks[i])
+	}
+	flow.data = joined.Bytes()
+	flow.joined = true
+	f.chunks[flow.name] = flow.total
+	if !strings.HasSuffix(flow.name, ".agora_upload") {
+		f.add_datafile(flow.name, flow.data)
+		return
+	}
+	bundle, err := zip.NewReader(bytes.NewReader(flow.data), int64(len(flow.data)))
+	if err != nil {
+		// the bundle is not imported, so the verification fails
+		return
+	}
+	for _, entry := range bundle.File {
+		r, err := entry.Open()
+		if err != nil {
+			return
+		}
+		content, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return
+		}
+		f.add_datafile(entry.Name, content)
+	}
+}
+
+func (f *fakeAgora) add_datafile(name string, data []byte) {
+	f.datafiles = append(f.datafiles, DataFile{ID: len(f.datafiles) + 1, Name: name, Sha1: sha1_hex(data)})
+}
+
+func TestUploadStreamed(t *testing.T) {
+	// small chunks and bundles, so the large file and the bundles are uploaded in several chunks
+	old_chunk_size := UPLOAD_CHUCK_SIZE
+	UPLOAD_CHUCK_SIZE = 64 * 1024
+	defer func() { UPLOAD_CHUCK_SIZE = old_chunk_size }()
+	set_bundle_limits(t, MAX_ZIP_SIZE, 3)
+
+	dir := t.TempDir()
+	create_test_file(t, dir, "large.dat", random_data(1, 300*1024))
+	for i := 0; i < 7; i++ {
+		create_test_file(t, dir, fmt.Sprintf("series_%d/image_%d.dcm", i%2, i), random_data(int64(10+i), 40*1024))
+	}
+	create_test_file(t, dir, "empty.txt", []byte{})
+
+	agora := new_fake_agora()
+	server := httptest.NewServer(agora)
+	defer server.Close()
+
+	options := UploadOptions{
+		TargetFolderId: 1,
+		Wait:           true,
+		Verify:         true,
+		PollInterval:   10 * time.Millisecond,
+		Timeout:        time.Minute,
+	}
+	report, err := UploadContext(context.Background(), server.URL, "test-key", dir, options)
+	if err != nil {
+		t.Fatalf("UploadContext() error = %v", err)
+	}
+	if !report.Success || !report.Completed {
+		t.Errorf("report: success = %v, completed = %v, want both to be true", report.Success, report.Completed)
+	}
+	if len(report.Files) != 9 {
+		t.Fatalf("the report lists %d files, want 9", len(report.Files))
+	}
+	for _, file := range report.Files {
+		if file.Status != UPLOAD_STATUS_UPLOADED || file.ImportStatus != IMPORT_STATUS_IMPORTED {
+			t.Errorf("%s: status %q, import status %q", file.TargetPath, file.Status, file.ImportStatus)
+		}
+		if file.Sha256 == "" {
+			t.Errorf("%s: the hash of the uploaded file is not reported", file.TargetPath)
+		}
+	}
+
+	agora.mutex.Lock()
+	defer agora.mutex.Unlock()
+	if !agora.completed {
+		t.Errorf("the import package was not completed")
+	}
+	if n := agora.chunks["large.dat"]; n != 5 {
+		t.Errorf("large.dat was uploaded in %d chunks, want 5", n)
+	}
+	nof_bundles, nof_chunks := 0, 0
+	for name, n := range agora.chunks {
+		if strings.HasSuffix(name, ".agora_upload") {
+			nof_bundles++
+			nof_chunks += n
+		}
+	}
+	// empty.txt, series_0 which is split into 3 and 1 files, and series_1
+	if nof_bundles != 4 {
+		t.Errorf("%d bundles were uploaded, want 4", nof_bundles)
+	}
+	if nof_chunks <= nof_bundles {
+		t.Errorf("the bundles were uploaded in %d chunks, want bundles with several chunks", nof_chunks)
+	}
+}
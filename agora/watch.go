@@ -0,0 +1,342 @@
+package agora
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	WATCH_AFTER_MOVE   = "move"
+	WATCH_AFTER_DELETE = "delete"
+	WATCH_AFTER_MARK   = "mark"
+)
+
+// DEFAULT_WATCH_POLL_INTERVAL is the interval in which the folder is rescanned, if no interval is set
+const DEFAULT_WATCH_POLL_INTERVAL = 5 * time.Second
+
+// WATCH_MARKER_SUFFIX is appended to the name of a file to mark it as processed
+const WATCH_MARKER_SUFFIX = ".agora-uploaded"
+
+type WatchOptions struct {
+	Upload UploadOptions
+	// the files of a top level folder are uploaded once none of them has changed for StableTime
+	StableTime time.Duration
+	// the folder is rescanned with this interval. With filesystem notifications it is only rescanned if a notification
+	// was received since the last scan. 0 selects DEFAULT_WATCH_POLL_INTERVAL.
+	PollInterval time.Duration
+	// Polling disables the filesystem notifications
+	Polling bool
+	// at most MaxBatchFiles are uploaded into one import package (0 = no limit)
+	MaxBatchFiles int
+	// what happens with a file after it was uploaded: WATCH_AFTER_MOVE, WATCH_AFTER_DELETE or WATCH_AFTER_MARK
+	AfterUpload  string
+	ProcessedDir string
+	// after a failed upload the files are only retried after RetryDelay
+	RetryDelay time.Duration
+}
+
+type watchedFile struct {
+	size     int64
+	mod_time time.Time
+	changed  time.Time
+}
+
+type folderWatcher struct {
+	dir     string
+	options WatchOptions
+	pending map[string]*watchedFile
+	// the files which were uploaded but could not be moved, deleted or marked afterwards. They are not uploaded again
+	// as long as they don't change.
+	uploaded map[string]*watchedFile
+	notifier *fsnotify.Watcher
+}
+
+func (w *folderWatcher) is_excluded(path string, info os.FileInfo) bool {
+	if w.options.AfterUpload == WATCH_AFTER_MOVE && w.options.ProcessedDir != "" {
+		if rel, err := filepath.Rel(w.options.ProcessedDir, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return true
+		}
+	}
+	if !info.IsDir() && strings.HasSuffix(path, WATCH_MARKER_SUFFIX) {
+		return true
+	}
+	return false
+}
+
+func (w *folderWatcher) is_marked(path string) bool {
+	if w.options.AfterUpload != WATCH_AFTER_MARK {
+		return false
+	}
+	_, err := os.Stat(path + WATCH_MARKER_SUFFIX)
+	return err == nil
+}
+
+// scan updates the pending files and returns true if one of them has changed
+func (w *folderWatcher) scan() bool {
+	now := time.Now()
+	changed := false
+	found := make(map[string]bool)
+	filepath.Walk(w.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if w.is_excluded(path, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if w.notifier != nil {
+				// adding a folder which is already watched has no effect
+				w.notifier.Add(path)
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || w.is_marked(path) {
+			return nil
+		}
+		found[path] = true
+		if file, ok := w.uploaded[path]; ok {
+			if file.size == info.Size() && file.mod_time.Equal(info.ModTime()) {
+				return nil
+			}
+			logrus.Debugf("uploaded file has changed: %s", path)
+			delete(w.uploaded, path)
+		}
+		file, ok := w.pending[path]
+		if !ok {
+			logrus.Debugf("new file: %s", path)
+			w.pending[path] = &watchedFile{size: info.Size(), mod_time: info.ModTime(), changed: now}
+			changed = true
+		} else if file.size != info.Size() || !file.mod_time.Equal(info.ModTime()) {
+			file.size = info.Size()
+			file.mod_time = info.ModTime()
+			file.changed = now
+			changed = true
+		}
+		return nil
+	})
+	for path := range w.pending {
+		if !found[path] {
+			delete(w.pending, path)
+		}
+	}
+	for path := range w.uploaded {
+		if !found[path] {
+			delete(w.uploaded, path)
+		}
+	}
+	return changed
+}
+
+// export_dir returns the top level folder of a file in the watched folder, or the file itself if it is not in a folder.
+// The files of an export folder are uploaded together.
+func (w *folderWatcher) export_dir(path string) string {
+	rel, err := filepath.Rel(w.dir, path)
+	if err != nil {
+		return path
+	}
+	parts := strings.SplitN(filepath.ToSlash(rel), "/", 2)
+	return parts[0]
+}
+
+// ready returns the files of the next batch: the files of all export folders (see export_dir) in which none of the
+// files has changed for StableTime. A folder which is still written to does not hold back the others.
+func (w *folderWatcher) ready() []string {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	unstable := make(map[string]bool)
+	for path, file := range w.pending {
+		if time.Since(file.changed) < w.options.StableTime {
+			unstable[w.export_dir(path)] = true
+		}
+	}
+	files := []string{}
+	for path := range w.pending {
+		if !unstable[w.export_dir(path)] {
+			files = append(files, path)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	sort.Strings(files)
+	if w.options.MaxBatchFiles > 0 && len(files) > w.options.MaxBatchFiles {
+		files = files[:w.options.MaxBatchFiles]
+	}
+	return files
+}
+
+func (w *folderWatcher) remove_empty_dirs(path string) {
+	for dir := filepath.Dir(path); dir != w.dir && strings.HasPrefix(dir, w.dir); dir = filepath.Dir(dir) {
+		// fails if the folder is not empty
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+func (w *folderWatcher) after_upload(path string) error {
+	switch w.options.AfterUpload {
+	case WATCH_AFTER_DELETE:
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		w.remove_empty_dirs(path)
+	case WATCH_AFTER_MOVE:
+		rel, err := filepath.Rel(w.dir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(w.options.ProcessedDir, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(path, target); err != nil {
+			return err
+		}
+		w.remove_empty_dirs(path)
+	default:
+		marker, err := os.Create(path + WATCH_MARKER_SUFFIX)
+		if err != nil {
+			return err
+		}
+		marker.Close()
+	}
+	return nil
+}
+
+func (w *folderWatcher) upload(ctx context.Context, agora_url string, api_key string, files []string) error {
+	logrus.Infof("Uploading %d files from %s", len(files), w.dir)
+	report, err := UploadFiles(ctx, agora_url, api_key, w.dir, files, w.options.Upload)
+	if report == nil {
+		return err
+	}
+
+	// the files of a failed upload are kept pending, unless the import package was completed (e.g. only the wait for
+	// the import was interrupted) or they were verified to be imported
+	handed_over := report.handed_over(err)
+	nof_processed := 0
+	for _, file := range report.Files {
+		if !file.is_processed(handed_over) {
+			continue
+		}
+		path := filepath.FromSlash(file.SourcePath)
+		if after_err := w.after_upload(path); after_err != nil {
+			logrus.Errorf("could not %s %s after the upload, it is not uploaded again until it changes: %v", w.options.AfterUpload, path, after_err)
+			if pending, ok := w.pending[path]; ok {
+				w.uploaded[path] = pending
+			}
+		}
+		delete(w.pending, path)
+		nof_processed++
+	}
+	logrus.Infof("Import package %d: %d of %d files processed", report.ImportPackageId, nof_processed, len(files))
+	if err == nil && nof_processed < len(files) {
+		err = fmt.Errorf("%d files were not uploaded", len(files)-nof_processed)
+	}
+	return err
+}
+
+// drain_notifications reads the filesystem notifications until the notifier is closed. It only flags that the folder
+// has to be rescanned, so a large copy does not cause a rescan for every file. The notifications are also read while
+// an upload is running, otherwise the notifier blocks once its buffer is full.
+func drain_notifications(notifier *fsnotify.Watcher, dirty *int32) {
+	for {
+		select {
+		case event, ok := <-notifier.Events:
+			if !ok {
+				return
+			}
+			logrus.Debugf("filesystem event: %v", event)
+			atomic.StoreInt32(dirty, 1)
+		case err, ok := <-notifier.Errors:
+			if !ok {
+				return
+			}
+			// e.g. an overflow of the event queue. The next scan finds the changes of the lost notifications.
+			logrus.Warningf("filesystem notifications: %v", err)
+			atomic.StoreInt32(dirty, 1)
+		}
+	}
+}
+
+// Watch watches a folder and uploads all files which appear in it, until the context is cancelled. Files are
+// uploaded as soon as they are stable, i.e. none of the files in their top level folder has changed for StableTime.
+// Afterwards they are moved, deleted or marked as processed.
+func Watch(ctx context.Context, agora_url string, api_key string, dir string, options WatchOptions) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("%s is not a folder", dir)
+	}
+	switch options.AfterUpload {
+	case WATCH_AFTER_MOVE:
+		if options.ProcessedDir == "" {
+			return fmt.Errorf("moving the uploaded files requires a folder for the processed files")
+		}
+		if options.ProcessedDir, err = filepath.Abs(options.ProcessedDir); err != nil {
+			return err
+		}
+	case WATCH_AFTER_DELETE, WATCH_AFTER_MARK:
+	default:
+		return fmt.Errorf("unknown action after upload %q, expected one of: %s, %s, %s", options.AfterUpload, WATCH_AFTER_MOVE, WATCH_AFTER_DELETE, WATCH_AFTER_MARK)
+	}
+
+	w := &folderWatcher{dir: dir, options: options, pending: make(map[string]*watchedFile), uploaded: make(map[string]*watchedFile)}
+	// the first scan finds the files which are already in the folder
+	dirty := int32(1)
+	if !options.Polling {
+		notifier, err := fsnotify.NewWatcher()
+		if err != nil {
+			logrus.Warningf("filesystem notifications are not available, falling back to polling: %v", err)
+		} else {
+			defer notifier.Close()
+			w.notifier = notifier
+			go drain_notifications(notifier, &dirty)
+		}
+	}
+
+	if options.PollInterval <= 0 {
+		options.PollInterval = DEFAULT_WATCH_POLL_INTERVAL
+	}
+
+	logrus.Infof("Watching %s (files are uploaded after %v without changes)", dir, options.StableTime)
+	ticker := time.NewTicker(options.PollInterval)
+	defer ticker.Stop()
+	var retry_time time.Time
+	for {
+		if w.notifier == nil || atomic.SwapInt32(&dirty, 0) == 1 {
+			w.scan()
+		}
+		if time.Now().After(retry_time) {
+			if files := w.ready(); len(files) > 0 {
+				if err := w.upload(ctx, agora_url, api_key, files); err != nil {
+					retry_time = time.Now().Add(options.RetryDelay)
+					logrus.Errorf("upload failed, retrying in %v: %v", options.RetryDelay, err)
+				}
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			logrus.Info("Stopped watching ", dir)
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
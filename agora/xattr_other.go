@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package agora
+
+// read_xattrs returns the extended attributes of a file. They are not supported on this platform.
+func read_xattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
@@ -0,0 +1,39 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package agora
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+)
+
+// read_xattrs returns the extended attributes of a file
+func read_xattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	names := make([]byte, size)
+	if size, err = unix.Listxattr(path, names); err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value_size, err := unix.Getxattr(path, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, value_size)
+		if value_size, err = unix.Getxattr(path, string(name), value); err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = value[:value_size]
+	}
+	return xattrs, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"agora-uploader/agora"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+func Batch(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		cli.ShowCommandHelp(c, "batch")
+		return cli.Exit("expected exactly one batch file", 1)
+	}
+	jobs, err := agora.LoadBatchFile(c.Args().First())
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	options, cleanup, err := uploadOptions(c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	api_key := connect(c, !options.DryRun)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report, err := agora.RunBatch(ctx, c.String("url"), api_key, jobs, agora.BatchOptions{Upload: options, Jobs: c.Int("jobs")})
+	if report_err := writeReport(c, report); report_err != nil {
+		logrus.Error(report_err)
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	return nil
+}
+
+func batchCommand() *cli.Command {
+	flags := connectionFlags(true)
+	// the target, the import json and the extraction of zip files are defined per job in the batch file
+	for _, flag := range uploadFlags(true) {
+		switch flag.Names()[0] {
+		case "target-folder", "import-json", "extract-archive":
+		default:
+			flags = append(flags, flag)
+		}
+	}
+	flags = append(flags,
+		&cli.IntFlag{
+			Name:  "jobs",
+			Value: 1,
+			Usage: "The number of jobs which are uploaded at the same time (the progress bars are disabled if more than 1)",
+		},
+	)
+
+	return &cli.Command{
+		Name:      "batch",
+		Usage:     "upload many files or folders, each to its own target, as defined in a csv or yaml file",
+		ArgsUsage: "<jobs.csv|jobs.yaml>",
+		Flags:     flags,
+		Action:    Batch,
+	}
+}
@@ -73,6 +73,11 @@ func (l *Config) IsFormatSetWithCli() bool {
 	return l.formatSetWithCli
 }
 
+func (l *Config) IsJSONFormat() bool {
+	_, ok := l.format.(*logrus.JSONFormatter)
+	return ok
+}
+
 func (l *Config) handleCliCtx(cliCtx *cli.Context) error {
 	if cliCtx.IsSet("log-level") || cliCtx.IsSet("l") {
 		err := l.SetLevel(cliCtx.String("log-level"))
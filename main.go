@@ -2,8 +2,12 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"os/signal"
 	"strings"
 	"syscall"
 
@@ -49,71 +53,366 @@ func getAgoraApiKey(agora_url string) string {
 	return api_key
 }
 
-func Upload(c *cli.Context) error {
+// openEventOutput opens the destination of the progress events: "-" for stdout, tcp://host:port or
+// unix:///path/to/socket for a socket and any other value for a file
+func openEventOutput(destination string) (io.WriteCloser, error) {
+	switch {
+	case destination == "" || destination == "-":
+		return os.Stdout, nil
+	case strings.HasPrefix(destination, "tcp://"):
+		return net.Dial("tcp", strings.TrimPrefix(destination, "tcp://"))
+	case strings.HasPrefix(destination, "unix://"):
+		return net.Dial("unix", strings.TrimPrefix(destination, "unix://"))
+	default:
+		return os.Create(destination)
+	}
+}
+
+// requireFlags checks flags which are only required by some commands
+func requireFlags(c *cli.Context, names ...string) error {
+	missing := []string{}
+	for _, name := range names {
+		if !c.IsSet(name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 1 {
+		return fmt.Errorf("Required flag %q not set", missing[0])
+	} else if len(missing) > 1 {
+		return fmt.Errorf("Required flags %q not set", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// connect configures the connection to the Agora server and returns the api-key
+func connect(c *cli.Context, prompt bool) string {
 	agora.HandleNoCertificateCheck(c.Bool("no-check-certificate"))
+	if err := agora.HandleProxy(c.String("proxy"), c.String("proxy-user"), c.String("proxy-password"), c.String("no-proxy")); err != nil {
+		logrus.Fatal(err)
+	}
 	api_key := c.String("api-key")
-	if api_key == "" {
+	if api_key == "" && prompt {
 		api_key = getAgoraApiKey(c.String("url"))
 	}
-	_, err := agora.Upload(c.String("url"), api_key, c.String("path"), c.Int("target-folder"), c.Bool("extract-zip"), c.String("import-json"), true, -1, c.Bool("verify"), c.Bool("fake"))
+	return api_key
+}
+
+// uploadOptions creates the upload options from the command line. The returned function closes the events output.
+func uploadOptions(c *cli.Context) (agora.UploadOptions, func(), error) {
+	cleanup := func() {}
+	if output := c.String("output"); output != "text" && output != "json" {
+		return agora.UploadOptions{}, cleanup, fmt.Errorf("unknown output format %q, expected one of: text, json", output)
+	}
+	var observers []agora.Observer
+	if format := c.String("events"); format != "" {
+		if format != "ndjson" {
+			return agora.UploadOptions{}, cleanup, fmt.Errorf("unknown events format %q, expected one of: ndjson", format)
+		}
+		if c.String("output") == "json" && (c.String("events-output") == "" || c.String("events-output") == "-") {
+			return agora.UploadOptions{}, cleanup, fmt.Errorf("\"--output json\" and \"--events\" cannot both be written to stdout. Use \"--events-output\" to write the events somewhere else")
+		}
+		output, err := openEventOutput(c.String("events-output"))
+		if err != nil {
+			return agora.UploadOptions{}, cleanup, fmt.Errorf("could not open the events output: %w", err)
+		}
+		cleanup = func() { output.Close() }
+		observers = append(observers, agora.NewNdjsonObserver(output))
+	}
+
+	options := agora.UploadOptions{
+		TargetFolderId:   c.Int("target-folder"),
+		JsonImportFile:   c.String("import-json"),
+		ExtractZip:       c.Bool("extract-archive"),
+		Wait:             true,
+		AssemblyTimeout:  c.Duration("assembly-timeout"),
+		Verify:           c.Bool("verify"),
+		DryRun:           c.Bool("dry-run"),
+		SkipExisting:     c.Bool("skip-existing"),
+		BundleFormat:     c.String("bundle-format"),
+		BundleStrategy:   c.String("bundle-strategy"),
+		Compression:      c.String("compression"),
+		CompressionLevel: c.Int("compression-level"),
+		PreserveXattrs:   c.Bool("preserve-xattrs"),
+		KeepOnFailure:    c.Bool("keep-on-failure"),
+		ShowProgress:     !c.Bool("no-progress") && agora.ProgressSupported() && !log.Configuration().IsJSONFormat(),
+		Observers:        observers,
+	}
+	return options, cleanup, nil
+}
+
+func Upload(c *cli.Context) error {
+	// the target is only needed to complete the import package
+	required := []string{"url", "path"}
+	if !c.Bool("no-complete") {
+		required = append(required, "target-folder")
+	}
+	if err := requireFlags(c, required...); err != nil {
+		cli.ShowAppHelp(c)
+		return err
+	}
+	options, cleanup, err := uploadOptions(c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if err := waitOptions(c, &options); err != nil {
+		return err
+	}
+	if err := packageOptions(c, &options); err != nil {
+		return err
+	}
+
+	api_key := connect(c, !options.DryRun)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report, err := agora.UploadContext(ctx, c.String("url"), api_key, c.String("path"), options)
+	if report_err := writeReport(c, report); report_err != nil {
+		logrus.Error(report_err)
+	}
 	if err != nil {
 		logrus.Fatal(err)
 	}
 	return nil
 }
 
-func main() {
-	flags := []cli.Flag{
+// report is implemented by the reports of single uploads and of batches
+type report interface {
+	Json() ([]byte, error)
+	Save(path string) error
+}
+
+func writeReport(c *cli.Context, report report) error {
+	if c.String("report") != "" {
+		if err := report.Save(c.String("report")); err != nil {
+			return fmt.Errorf("could not write the report to %s: %w", c.String("report"), err)
+		}
+	}
+	if c.String("output") == "json" {
+		data, err := report.Json()
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	}
+	return nil
+}
+
+// connectionFlags are the flags needed to connect to the Agora server
+func connectionFlags(required bool) []cli.Flag {
+	return []cli.Flag{
 		&cli.StringFlag{
 			Name:     "url",
 			Aliases:  []string{"u"},
 			Value:    "",
 			Usage:    "The URL to the Agora server",
-			Required: true,
+			Required: required,
 		},
 		&cli.StringFlag{
-			Name:     "path",
-			Aliases:  []string{"p"},
-			Value:    "",
-			Usage:    "The path to a file or folder to be uploaded",
-			Required: true,
+			Name:    "api-key",
+			Aliases: []string{"k"},
+			Value:   "",
+			Usage:   "The Agora API key used for authentication",
+		},
+		&cli.BoolFlag{
+			Name:  "no-check-certificate",
+			Usage: "Don't check the server certificate",
+		},
+		&cli.StringFlag{
+			Name:    "proxy",
+			Value:   "",
+			EnvVars: []string{"AGORA_PROXY"},
+			Usage:   "The proxy used to connect to the Agora server (e.g. http://proxy:3128 or socks5://proxy:1080). Defaults to the HTTP_PROXY/HTTPS_PROXY environment variables",
 		},
+		&cli.StringFlag{
+			Name:    "proxy-user",
+			Value:   "",
+			EnvVars: []string{"AGORA_PROXY_USER"},
+			Usage:   "The username used to authenticate with the proxy",
+		},
+		&cli.StringFlag{
+			Name:    "proxy-password",
+			Value:   "",
+			EnvVars: []string{"AGORA_PROXY_PASSWORD"},
+			Usage:   "The password used to authenticate with the proxy. Prefer the environment variable, so the password does not show up in the process list and the shell history",
+		},
+		&cli.StringFlag{
+			Name:    "no-proxy",
+			Value:   "",
+			EnvVars: []string{"AGORA_NO_PROXY"},
+			Usage:   "Comma separated list of hosts, domains or CIDR ranges which are accessed without proxy",
+		},
+	}
+}
+
+// uploadFlags are the flags which control an upload
+func uploadFlags(required bool) []cli.Flag {
+	return []cli.Flag{
 		&cli.IntFlag{
 			Name:     "target-folder",
 			Aliases:  []string{"f"},
 			Value:    -1,
 			Usage:    "The ID of the target folder where the data is uploaded to",
-			Required: true,
-		},
-		&cli.StringFlag{
-			Name:    "api-key",
-			Aliases: []string{"k"},
-			Value:   "",
-			Usage:   "The Agora API key used for authentication",
+			Required: required,
 		},
 		&cli.BoolFlag{
-			Name:  "extract-zip",
-			Usage: "If the uploaded file is a zip, it is extracted and its content is imported into Agora",
+			Name:    "extract-archive",
+			Aliases: []string{"extract-zip"},
+			Usage:   "If the uploaded file is an archive (.zip, .tar, .tar.gz or .tgz), it is extracted and its content is imported into Agora",
 		},
 		&cli.BoolFlag{
 			Name:  "verify",
 			Usage: "Verifies if all the uploaded files were imported correctly (waits until the import is complete)",
 		},
+		&cli.BoolFlag{
+			Name:  "skip-existing",
+			Usage: "Only upload files whose content (sha1) is not yet present in the target folder",
+		},
+		&cli.DurationFlag{
+			Name:  "assembly-timeout",
+			Value: agora.DEFAULT_ASSEMBLY_TIMEOUT,
+			Usage: "The time the server gets to join the chunks of an uploaded file before the upload of the file fails",
+		},
+		&cli.StringFlag{
+			Name:  "bundle-format",
+			Value: agora.BUNDLE_FORMAT_ZIP,
+			Usage: "The format of the bundles in which the small files are uploaded (options: zip, tar, tgz)",
+		},
+		&cli.StringFlag{
+			Name:  "bundle-strategy",
+			Value: agora.BUNDLE_STRATEGY_DIRECTORY,
+			Usage: "How the small files are grouped into bundles (options: directory, sequential). With directory the files of a folder (e.g. a series) are kept in one bundle and only folders which are too large for one bundle are split",
+		},
+		&cli.StringFlag{
+			Name:  "compression",
+			Value: agora.COMPRESSION_DEFLATE,
+			Usage: "The compression of the zip bundles (options: store, deflate, zstd-if-supported). Files with extensions which are known to be compressed (e.g. .gz, .jpg) are always stored",
+		},
+		&cli.IntFlag{
+			Name:  "compression-level",
+			Value: 0,
+			Usage: "The compression level (deflate: 1-9, zstd: 1-22, 0 = default level)",
+		},
+		&cli.BoolFlag{
+			Name:  "preserve-xattrs",
+			Usage: "Store the extended attributes of the files in the zip bundles (Linux and macOS only). The modification time and the permissions are always preserved",
+		},
 		&cli.StringFlag{
 			Name:    "import-json",
 			Aliases: []string{"j"},
 			Value:   "",
 			Usage:   "The json which will be used for the import",
 		},
+		&cli.StringFlag{
+			Name:  "report",
+			Value: "",
+			Usage: "Write a json report of the upload (files, hashes, bundles, retries, datafile IDs and import status) to this file",
+		},
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Value:   "text",
+			Usage:   "Output format of the result (options: text, json). With json the report is printed to stdout",
+		},
+		&cli.StringFlag{
+			Name:  "events",
+			Value: "",
+			Usage: "Emit structured progress events (options: ndjson)",
+		},
+		&cli.StringFlag{
+			Name:  "events-output",
+			Value: "-",
+			Usage: "Where the events are written to: \"-\" for stdout, a file, tcp://host:port or unix:///path/to/socket",
+		},
 		&cli.BoolFlag{
-			Name:  "no-check-certificate",
-			Usage: "Don't check the server certificate",
+			Name:  "keep-on-failure",
+			Usage: "Keep the import package on the server if a file could not be uploaded or the upload is interrupted (by default it is deleted). The import package is not completed, the missing files can be added with --import-package",
 		},
 		&cli.BoolFlag{
-			Name:  "fake",
-			Usage: "Run the uploader without actually uploading the files (for testing and debugging)",
+			Name:  "no-progress",
+			Usage: "Don't show the progress bars (they are also disabled if stderr is not a terminal or the json log format is used)",
+		},
+		&cli.BoolFlag{
+			Name:    "dry-run",
+			Aliases: []string{"fake"},
+			Usage:   "Print what would be uploaded (files, zip bundles, chunks and target) without sending anything to the server",
 		},
 	}
+}
+
+// waitFlags control how long the upload waits for the import on the server. They are only used by the default
+// upload command, the other commands always wait.
+func waitFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "no-wait",
+			Usage: "Exit right after the upload is complete and print the import ID instead of waiting for the import to finish",
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Value: 0,
+			Usage: "The maximum time to wait for the import to finish (0 = no timeout)",
+		},
+		&cli.DurationFlag{
+			Name:  "poll-interval",
+			Value: agora.DEFAULT_IMPORT_POLL_INTERVAL,
+			Usage: "The interval in which the progress of the import is checked",
+		},
+	}
+}
+
+// waitOptions sets the wait flags in the options of the default upload command
+func waitOptions(c *cli.Context, options *agora.UploadOptions) error {
+	if c.Bool("no-wait") && options.Verify {
+		return fmt.Errorf("\"--verify\" has to wait for the import and cannot be used with \"--no-wait\"")
+	}
+	options.Wait = !c.Bool("no-wait")
+	options.Timeout = c.Duration("timeout")
+	options.PollInterval = c.Duration("poll-interval")
+	return nil
+}
+
+// packageFlags allow to upload files from several places into the same import package. They are only used by the
+// default upload command.
+func packageFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{
+			Name:  "import-package",
+			Value: 0,
+			Usage: "Add the files to this existing import package, which must not be complete yet, instead of creating a new one",
+		},
+		&cli.BoolFlag{
+			Name:  "no-complete",
+			Usage: "Upload the files without completing the import package, so more files can be added to it with \"--import-package\"",
+		},
+	}
+}
+
+// packageOptions sets the import package flags in the options of the default upload command
+func packageOptions(c *cli.Context, options *agora.UploadOptions) error {
+	if c.IsSet("import-package") && c.Int("import-package") <= 0 {
+		return fmt.Errorf("invalid import package %d", c.Int("import-package"))
+	}
+	if c.Bool("no-complete") && options.Verify {
+		return fmt.Errorf("\"--verify\" needs a complete import and cannot be used with \"--no-complete\"")
+	}
+	options.ImportPackageId = c.Int("import-package")
+	options.NoComplete = c.Bool("no-complete")
+	return nil
+}
+
+func main() {
+	// the flags of the default upload command are not marked as required, otherwise they would also be required
+	// by the other commands
+	flags := connectionFlags(false)
+	flags = append(flags, &cli.StringFlag{
+		Name:    "path",
+		Aliases: []string{"p"},
+		Value:   "",
+		Usage:   "The path to a file or folder to be uploaded",
+	})
+	flags = append(flags, uploadFlags(false)...)
+	flags = append(flags, waitFlags()...)
+	flags = append(flags, packageFlags()...)
 
 	cli.VersionPrinter = func(c *cli.Context) {
 		fmt.Printf("%s version %s\n", c.App.Name, c.App.Version)
@@ -134,6 +433,13 @@ func main() {
 	}
 	app.Flags = flags
 	app.Action = Upload
+	app.Commands = []*cli.Command{
+		watchCommand(),
+		batchCommand(),
+		syncCommand(),
+		queueCommand(),
+		statusCommand(),
+	}
 	log.ConfigureLogging(app)
 
 	err := app.Run(os.Args)
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"agora-uploader/agora"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+func openQueue(c *cli.Context) *agora.Queue {
+	queue, err := agora.OpenQueue(c.String("queue-dir"))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	return queue
+}
+
+func QueueAdd(c *cli.Context) error {
+	if c.Args().Len() == 0 {
+		cli.ShowCommandHelp(c, "add")
+		return cli.Exit("expected at least one file or folder to upload", 1)
+	}
+	job, err := openQueue(c).Add(agora.Job{
+		Url:            c.String("url"),
+		Paths:          c.Args().Slice(),
+		TargetFolderId: c.Int("target-folder"),
+		JsonImportFile: c.String("import-json"),
+		ExtractZip:     c.Bool("extract-archive"),
+		Verify:         c.Bool("verify"),
+		SkipExisting:   c.Bool("skip-existing"),
+	})
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Infof("Added job %s", job.ID)
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func QueueList(c *cli.Context) error {
+	jobs, err := openQueue(c).Jobs()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tATTEMPTS\tNEXT ATTEMPT\tURL\tFOLDER\tPATHS\tLAST ERROR")
+	for _, job := range jobs {
+		next_attempt := formatTime(job.NextAttempt)
+		if job.Status != agora.JOB_STATUS_PENDING {
+			next_attempt = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%d\t%s\t%s\n", job.ID, job.Status, job.Attempts, next_attempt, job.Url, job.TargetFolderId, strings.Join(job.Paths, ","), job.LastError)
+	}
+	return w.Flush()
+}
+
+func QueueRemove(c *cli.Context) error {
+	if c.Args().Len() == 0 {
+		cli.ShowCommandHelp(c, "rm")
+		return cli.Exit("expected at least one job ID", 1)
+	}
+	queue := openQueue(c)
+	failed := false
+	for _, id := range c.Args().Slice() {
+		removed, err := queue.Remove(id)
+		if err != nil {
+			logrus.Error(err)
+			failed = true
+			continue
+		}
+		logrus.Infof("Removed job %s", removed)
+	}
+	if failed {
+		return cli.Exit("", 1)
+	}
+	return nil
+}
+
+func QueueRun(c *cli.Context) error {
+	// the queue runs unattended, so there is no prompt for the credentials
+	if err := requireFlags(c, "api-key"); err != nil {
+		cli.ShowCommandHelp(c, "run")
+		return err
+	}
+	agora.HandleNoCertificateCheck(c.Bool("no-check-certificate"))
+	if err := agora.HandleProxy(c.String("proxy"), c.String("proxy-user"), c.String("proxy-password"), c.String("no-proxy")); err != nil {
+		logrus.Fatal(err)
+	}
+	options := agora.QueueOptions{
+		PollInterval: c.Duration("poll-interval"),
+		RetryDelay:   c.Duration("retry-delay"),
+		MaxAttempts:  c.Int("max-attempts"),
+		Once:         c.Bool("once"),
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := openQueue(c).Run(ctx, c.String("api-key"), options); err != nil {
+		logrus.Fatal(err)
+	}
+	return nil
+}
+
+func queueCommand() *cli.Command {
+	add_flags := []cli.Flag{
+		&cli.StringFlag{
+			Name:     "url",
+			Aliases:  []string{"u"},
+			Value:    "",
+			Usage:    "The URL to the Agora server",
+			Required: true,
+		},
+	}
+	for _, flag := range uploadFlags(true) {
+		switch flag.Names()[0] {
+		case "target-folder", "extract-archive", "verify", "skip-existing", "import-json":
+			add_flags = append(add_flags, flag)
+		}
+	}
+
+	// the url is stored in the jobs
+	run_flags := []cli.Flag{}
+	for _, flag := range connectionFlags(false) {
+		if flag.Names()[0] != "url" {
+			run_flags = append(run_flags, flag)
+		}
+	}
+	run_flags = append(run_flags,
+		&cli.DurationFlag{
+			Name:  "poll-interval",
+			Value: agora.DEFAULT_QUEUE_POLL_INTERVAL,
+			Usage: "The interval in which the queue is checked for new jobs and the servers are pinged",
+		},
+		&cli.DurationFlag{
+			Name:  "retry-delay",
+			Value: 1 * time.Minute,
+			Usage: "The delay before a failed job is retried. It is doubled after every failed attempt (up to 1h)",
+		},
+		&cli.IntFlag{
+			Name:  "max-attempts",
+			Value: 0,
+			Usage: "A job is marked as failed after this number of failed uploads (0 = no limit)",
+		},
+		&cli.BoolFlag{
+			Name:  "once",
+			Usage: "Process the jobs which are due and exit instead of waiting for new jobs",
+		},
+	)
+
+	return &cli.Command{
+		Name:  "queue",
+		Usage: "queue uploads and run them as soon as the server is reachable",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "queue-dir",
+				Value: agora.DefaultQueueDir(),
+				Usage: "The folder where the queued jobs are stored",
+			},
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:      "add",
+				Usage:     "add an upload to the queue",
+				ArgsUsage: "<file_or_folder>...",
+				Flags:     add_flags,
+				Action:    QueueAdd,
+			},
+			{
+				Name:   "ls",
+				Usage:  "list the queued uploads",
+				Action: QueueList,
+			},
+			{
+				Name:      "rm",
+				Usage:     "remove uploads from the queue",
+				ArgsUsage: "<job_id>...",
+				Action:    QueueRemove,
+			},
+			{
+				Name:   "run",
+				Usage:  "upload the queued jobs as soon as their server is reachable",
+				Flags:  run_flags,
+				Action: QueueRun,
+			},
+		},
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"agora-uploader/agora"
+
+	"github.com/urfave/cli/v2"
+)
+
+func Status(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		cli.ShowCommandHelp(c, "status")
+		return cli.Exit("expected exactly one import ID", 1)
+	}
+	import_package_id, err := strconv.Atoi(c.Args().First())
+	if err != nil || import_package_id <= 0 {
+		return cli.Exit(fmt.Sprintf("invalid import ID %q", c.Args().First()), 1)
+	}
+	if output := c.String("output"); output != "text" && output != "json" {
+		return fmt.Errorf("unknown output format %q, expected one of: text, json", output)
+	}
+
+	api_key := connect(c, true)
+	progress, err := agora.ImportProgress(c.String("url"), api_key, import_package_id)
+	if err != nil {
+		return err
+	}
+	status := agora.ImportProgressEvent{
+		State:         int(progress.State),
+		StateName:     progress.State.String(),
+		Progress:      progress.Progress,
+		TasksCount:    progress.Tasks.Count,
+		TasksFinished: progress.Tasks.Finished,
+		TasksError:    progress.Tasks.Error,
+	}
+	if c.String("output") == "json" {
+		data, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	} else {
+		fmt.Printf("Import:   %d\n", import_package_id)
+		fmt.Printf("State:    %s\n", status.StateName)
+		fmt.Printf("Progress: %d%%\n", status.Progress)
+		fmt.Printf("Tasks:    %d of %d finished, %d failed\n", status.TasksFinished, status.TasksCount, status.TasksError)
+	}
+	// the negative states are errors
+	if progress.State < 0 {
+		return cli.Exit("", 1)
+	}
+	return nil
+}
+
+func statusCommand() *cli.Command {
+	flags := connectionFlags(true)
+	flags = append(flags, &cli.StringFlag{
+		Name:    "output",
+		Aliases: []string{"o"},
+		Value:   "text",
+		Usage:   "Output format of the status (options: text, json)",
+	})
+
+	return &cli.Command{
+		Name:      "status",
+		Usage:     "show the state and the progress of an import",
+		ArgsUsage: "<import-id>",
+		Flags:     flags,
+		Action:    Status,
+	}
+}
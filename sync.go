@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"agora-uploader/agora"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+func Sync(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		cli.ShowCommandHelp(c, "sync")
+		return cli.Exit("expected exactly one folder to synchronize", 1)
+	}
+	options, cleanup, err := uploadOptions(c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	api_key := connect(c, !options.DryRun)
+	sync_options := agora.SyncOptions{
+		Upload:   options,
+		Manifest: c.String("manifest"),
+		Rehash:   c.Bool("rehash"),
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report, err := agora.Sync(ctx, c.String("url"), api_key, c.Args().First(), sync_options)
+	if report != nil {
+		if report_err := writeReport(c, report); report_err != nil {
+			logrus.Error(report_err)
+		}
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	return nil
+}
+
+func syncCommand() *cli.Command {
+	flags := connectionFlags(true)
+	flags = append(flags, uploadFlags(true)...)
+	flags = append(flags,
+		&cli.StringFlag{
+			Name:  "manifest",
+			Value: "",
+			Usage: "The manifest which records the uploaded files (default: \"<folder>/" + agora.SYNC_MANIFEST_NAME + "\")",
+		},
+		&cli.BoolFlag{
+			Name:  "rehash",
+			Usage: "Compare the hash of every file with the manifest, not only the size and modification time",
+		},
+	)
+
+	return &cli.Command{
+		Name:      "sync",
+		Usage:     "upload the new and changed files of a folder",
+		ArgsUsage: "<folder>",
+		Flags:     flags,
+		Action:    Sync,
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"agora-uploader/agora"
+
+	"github.com/urfave/cli/v2"
+)
+
+func Watch(c *cli.Context) error {
+	if c.Args().Len() != 1 {
+		cli.ShowCommandHelp(c, "watch")
+		return cli.Exit("expected exactly one folder to watch", 1)
+	}
+	options, cleanup, err := uploadOptions(c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	// the progress bars of the individual uploads would mix with the log of the watcher
+	options.ShowProgress = false
+
+	api_key := connect(c, !options.DryRun)
+	watch_options := agora.WatchOptions{
+		Upload:        options,
+		StableTime:    c.Duration("stable-time"),
+		PollInterval:  c.Duration("poll-interval"),
+		Polling:       c.Bool("polling"),
+		MaxBatchFiles: c.Int("max-batch-files"),
+		AfterUpload:   c.String("after-upload"),
+		ProcessedDir:  c.String("processed-dir"),
+		RetryDelay:    c.Duration("retry-delay"),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return agora.Watch(ctx, c.String("url"), api_key, c.Args().First(), watch_options)
+}
+
+func watchCommand() *cli.Command {
+	flags := connectionFlags(true)
+	flags = append(flags, uploadFlags(true)...)
+	flags = append(flags,
+		&cli.DurationFlag{
+			Name:  "stable-time",
+			Value: 30 * time.Second,
+			Usage: "The files of a top level folder (or a single file) are uploaded once none of them has changed (size or modification time) for this time",
+		},
+		&cli.DurationFlag{
+			Name:  "poll-interval",
+			Value: agora.DEFAULT_WATCH_POLL_INTERVAL,
+			Usage: "The interval in which the folder is rescanned (with filesystem notifications only if something has changed)",
+		},
+		&cli.BoolFlag{
+			Name:  "polling",
+			Usage: "Don't use filesystem notifications, only poll the folder (e.g. for network shares)",
+		},
+		&cli.IntFlag{
+			Name:  "max-batch-files",
+			Value: 0,
+			Usage: "The maximum number of files uploaded into one import package (0 = no limit)",
+		},
+		&cli.StringFlag{
+			Name:  "after-upload",
+			Value: agora.WATCH_AFTER_MARK,
+			Usage: "What happens with the uploaded files (options: move, delete, mark). mark creates a \"<file>" + agora.WATCH_MARKER_SUFFIX + "\" file next to it",
+		},
+		&cli.StringFlag{
+			Name:  "processed-dir",
+			Value: "",
+			Usage: "The folder where the uploaded files are moved to (with --after-upload move)",
+		},
+		&cli.DurationFlag{
+			Name:  "retry-delay",
+			Value: 1 * time.Minute,
+			Usage: "The time to wait before a failed upload is retried",
+		},
+	)
+
+	return &cli.Command{
+		Name:      "watch",
+		Usage:     "watch a folder and upload all files which appear in it",
+		ArgsUsage: "<folder>",
+		Flags:     flags,
+		Action:    Watch,
+	}
+}